@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec decodes and encodes request/response bodies in a particular wire
+// format. Handlers go through decodeBody/encodeResponse rather than calling a
+// Codec directly, so they don't have to look at Content-Type/Accept
+// themselves.
+type Codec interface {
+	Decode(r io.Reader, v any) error
+	Encode(w io.Writer, v any) error
+}
+
+// codecs maps a MIME type to the Codec that handles it. Populated by each
+// codec's init function rather than here, so adding a new format only means
+// adding a new file, not editing this one.
+var codecs = map[string]Codec{}
+
+// defaultContentType is used when a request has no Content-Type, or an
+// Accept header doesn't name a registered type (including "*/*" or "").
+const defaultContentType = "application/json"
+
+func init() {
+	codecs["application/json"] = jsonCodec{}
+	codecs["application/msgpack"] = msgpackCodec{}
+	codecs["application/x-protobuf"] = protobufCodec{}
+}
+
+// codecFor resolves a Content-Type or Accept header value to a registered
+// Codec and the MIME type it was registered under. It never returns a nil
+// Codec: unset or unrecognized headers fall back to defaultContentType.
+func codecFor(headerValue string) (Codec, string) {
+	mediaType, _, err := mime.ParseMediaType(headerValue)
+	if err == nil {
+		if c, ok := codecs[mediaType]; ok {
+			return c, mediaType
+		}
+	}
+	return codecs[defaultContentType], defaultContentType
+}
+
+// decodeBody decodes r's body according to its Content-Type header.
+func decodeBody(r *http.Request, v any) error {
+	codec, _ := codecFor(r.Header.Get("Content-Type"))
+	return codec.Decode(r.Body, v)
+}
+
+// encodeResponse encodes v to w according to r's Accept header, and sets the
+// matching Content-Type on w before writing.
+func encodeResponse(w http.ResponseWriter, r *http.Request, v any) error {
+	codec, mediaType := codecFor(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", mediaType)
+	return codec.Encode(w, v)
+}
+
+// jsonCodec is the original wire format and remains the default for clients
+// that don't set Content-Type/Accept at all.
+type jsonCodec struct{}
+
+func (jsonCodec) Decode(r io.Reader, v any) error { return json.NewDecoder(r).Decode(v) }
+func (jsonCodec) Encode(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) }
+
+// msgpackCodec handles "application/msgpack". Unlike protobuf, msgpack
+// encodes arbitrary Go values (maps, slices, interface{}) the same way JSON
+// does, so it needs no per-type glue code.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Decode(r io.Reader, v any) error { return msgpack.NewDecoder(r).Decode(v) }
+func (msgpackCodec) Encode(w io.Writer, v any) error { return msgpack.NewEncoder(w).Encode(v) }
+
+// protobufCodec handles "application/x-protobuf". Protobuf has no generic
+// encoding for interface{}, so it only supports the concrete request/response
+// types the API actually uses; everything else is a decode/encode error.
+// Task.Input, Result.Output, and Task.Metadata are arbitrary values, so they
+// travel inside the message as a nested JSON-encoded bytes field rather than
+// as proper protobuf fields.
+type protobufCodec struct{}
+
+func (protobufCodec) Decode(r io.Reader, v any) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	switch m := v.(type) {
+	case *Task:
+		return decodeTaskProto(data, m)
+	case *Result:
+		return decodeResultProto(data, m)
+	case *leaseRequest:
+		return decodeLeaseRequestProto(data, m)
+	case *submitResponse:
+		return decodeSubmitResponseProto(data, m)
+	case *TopicSchema:
+		return decodeTopicSchemaProto(data, m)
+	default:
+		return fmt.Errorf("protobuf codec: unsupported type %T", v)
+	}
+}
+
+func (protobufCodec) Encode(w io.Writer, v any) error {
+	var data []byte
+	switch m := v.(type) {
+	case Task:
+		data = encodeTaskProto(m)
+	case *Task:
+		data = encodeTaskProto(*m)
+	case Result:
+		data = encodeResultProto(m)
+	case *Result:
+		data = encodeResultProto(*m)
+	case leaseRequest:
+		data = encodeLeaseRequestProto(m)
+	case *leaseRequest:
+		data = encodeLeaseRequestProto(*m)
+	case submitResponse:
+		data = encodeSubmitResponseProto(m)
+	case *submitResponse:
+		data = encodeSubmitResponseProto(*m)
+	case TopicSchema:
+		data = encodeTopicSchemaProto(m)
+	case *TopicSchema:
+		data = encodeTopicSchemaProto(*m)
+	default:
+		return fmt.Errorf("protobuf codec: unsupported type %T", v)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Field numbers below are chosen once and must not be reassigned, same as in
+// a .proto file - they're the wire-compatible identity of each field.
+const (
+	taskFieldID                = 1
+	taskFieldTopic              = 2
+	taskFieldInput              = 3
+	taskFieldStatus             = 4
+	taskFieldTimestamp          = 5
+	taskFieldSubmitTime         = 6
+	taskFieldAttempts           = 7
+	taskFieldMaxAttempts        = 8
+	taskFieldVisibilityTimeout  = 9
+	taskFieldLeaseID            = 10
+	taskFieldMetadata           = 11
+)
+
+func encodeTaskProto(t Task) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, taskFieldID, protowire.BytesType)
+	b = protowire.AppendString(b, t.ID)
+	b = protowire.AppendTag(b, taskFieldTopic, protowire.BytesType)
+	b = protowire.AppendString(b, t.Topic)
+	if input, err := json.Marshal(t.Input); err == nil {
+		b = protowire.AppendTag(b, taskFieldInput, protowire.BytesType)
+		b = protowire.AppendBytes(b, input)
+	}
+	b = protowire.AppendTag(b, taskFieldStatus, protowire.BytesType)
+	b = protowire.AppendString(b, t.Status)
+	b = protowire.AppendTag(b, taskFieldTimestamp, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Timestamp.UnixNano()))
+	b = protowire.AppendTag(b, taskFieldSubmitTime, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.SubmitTime.UnixNano()))
+	b = protowire.AppendTag(b, taskFieldAttempts, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Attempts))
+	b = protowire.AppendTag(b, taskFieldMaxAttempts, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.MaxAttempts))
+	b = protowire.AppendTag(b, taskFieldVisibilityTimeout, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.VisibilityTimeout))
+	b = protowire.AppendTag(b, taskFieldLeaseID, protowire.BytesType)
+	b = protowire.AppendString(b, t.LeaseID)
+	if len(t.Metadata) > 0 {
+		if metadata, err := json.Marshal(t.Metadata); err == nil {
+			b = protowire.AppendTag(b, taskFieldMetadata, protowire.BytesType)
+			b = protowire.AppendBytes(b, metadata)
+		}
+	}
+	return b
+}
+
+func decodeTaskProto(data []byte, t *Task) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case taskFieldID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.ID = v
+			data = data[n:]
+		case taskFieldTopic:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.Topic = v
+			data = data[n:]
+		case taskFieldInput:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if len(v) > 0 {
+				if err := json.Unmarshal(v, &t.Input); err != nil {
+					return err
+				}
+			}
+			data = data[n:]
+		case taskFieldStatus:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.Status = v
+			data = data[n:]
+		case taskFieldTimestamp:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.Timestamp = time.Unix(0, int64(v))
+			data = data[n:]
+		case taskFieldSubmitTime:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.SubmitTime = time.Unix(0, int64(v))
+			data = data[n:]
+		case taskFieldAttempts:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.Attempts = int(v)
+			data = data[n:]
+		case taskFieldMaxAttempts:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.MaxAttempts = int(v)
+			data = data[n:]
+		case taskFieldVisibilityTimeout:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.VisibilityTimeout = time.Duration(v)
+			data = data[n:]
+		case taskFieldLeaseID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			t.LeaseID = v
+			data = data[n:]
+		case taskFieldMetadata:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if len(v) > 0 {
+				if err := json.Unmarshal(v, &t.Metadata); err != nil {
+					return err
+				}
+			}
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+const (
+	resultFieldID      = 1
+	resultFieldOutput  = 2
+	resultFieldLeaseID = 3
+)
+
+func encodeResultProto(r Result) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, resultFieldID, protowire.BytesType)
+	b = protowire.AppendString(b, r.ID)
+	if output, err := json.Marshal(r.Output); err == nil {
+		b = protowire.AppendTag(b, resultFieldOutput, protowire.BytesType)
+		b = protowire.AppendBytes(b, output)
+	}
+	b = protowire.AppendTag(b, resultFieldLeaseID, protowire.BytesType)
+	b = protowire.AppendString(b, r.LeaseID)
+	return b
+}
+
+func decodeResultProto(data []byte, r *Result) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case resultFieldID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			r.ID = v
+			data = data[n:]
+		case resultFieldOutput:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if len(v) > 0 {
+				if err := json.Unmarshal(v, &r.Output); err != nil {
+					return err
+				}
+			}
+			data = data[n:]
+		case resultFieldLeaseID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			r.LeaseID = v
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+const (
+	leaseRequestFieldID      = 1
+	leaseRequestFieldLeaseID = 2
+)
+
+func encodeLeaseRequestProto(req leaseRequest) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, leaseRequestFieldID, protowire.BytesType)
+	b = protowire.AppendString(b, req.ID)
+	b = protowire.AppendTag(b, leaseRequestFieldLeaseID, protowire.BytesType)
+	b = protowire.AppendString(b, req.LeaseID)
+	return b
+}
+
+func decodeLeaseRequestProto(data []byte, req *leaseRequest) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case leaseRequestFieldID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			req.ID = v
+			data = data[n:]
+		case leaseRequestFieldLeaseID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			req.LeaseID = v
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+const (
+	topicSchemaFieldTopic        = 1
+	topicSchemaFieldInputSchema  = 2
+	topicSchemaFieldOutputSchema = 3
+)
+
+func encodeTopicSchemaProto(s TopicSchema) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, topicSchemaFieldTopic, protowire.BytesType)
+	b = protowire.AppendString(b, s.Topic)
+	if len(s.InputSchema) > 0 {
+		b = protowire.AppendTag(b, topicSchemaFieldInputSchema, protowire.BytesType)
+		b = protowire.AppendBytes(b, s.InputSchema)
+	}
+	if len(s.OutputSchema) > 0 {
+		b = protowire.AppendTag(b, topicSchemaFieldOutputSchema, protowire.BytesType)
+		b = protowire.AppendBytes(b, s.OutputSchema)
+	}
+	return b
+}
+
+func decodeTopicSchemaProto(data []byte, s *TopicSchema) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case topicSchemaFieldTopic:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			s.Topic = v
+			data = data[n:]
+		case topicSchemaFieldInputSchema:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if len(v) > 0 {
+				s.InputSchema = append(json.RawMessage(nil), v...)
+			}
+			data = data[n:]
+		case topicSchemaFieldOutputSchema:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if len(v) > 0 {
+				s.OutputSchema = append(json.RawMessage(nil), v...)
+			}
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+const submitResponseFieldID = 1
+
+func encodeSubmitResponseProto(resp submitResponse) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, submitResponseFieldID, protowire.BytesType)
+	b = protowire.AppendString(b, resp.ID)
+	return b
+}
+
+func decodeSubmitResponseProto(data []byte, resp *submitResponse) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch num {
+		case submitResponseFieldID:
+			v, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			resp.ID = v
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCodecFor(t *testing.T) {
+	cases := []struct {
+		header       string
+		wantMIMEType string
+	}{
+		{"application/json", "application/json"},
+		{"application/msgpack", "application/msgpack"},
+		{"application/x-protobuf", "application/x-protobuf"},
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/xml", "application/json"},
+	}
+	for _, c := range cases {
+		_, mimeType := codecFor(c.header)
+		if mimeType != c.wantMIMEType {
+			t.Errorf("codecFor(%q) mime type = %q, want %q", c.header, mimeType, c.wantMIMEType)
+		}
+	}
+}
+
+func TestMsgpackCodecRoundTrip(t *testing.T) {
+	task := Task{ID: "t1", Topic: "topic", Input: map[string]interface{}{"k": "v"}, Status: "new"}
+
+	var buf bytes.Buffer
+	if err := (msgpackCodec{}).Encode(&buf, task); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	var decoded Task
+	if err := (msgpackCodec{}).Decode(&buf, &decoded); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded.ID != task.ID || decoded.Topic != task.Topic || decoded.Status != task.Status {
+		t.Errorf("round-tripped task = %+v, want %+v", decoded, task)
+	}
+}
+
+func TestProtobufCodecRoundTripTask(t *testing.T) {
+	task := Task{
+		ID:                "t1",
+		Topic:             "topic",
+		Input:             map[string]interface{}{"k": "v"},
+		Status:            "pending",
+		Timestamp:         time.Unix(1000, 0),
+		SubmitTime:        time.Unix(900, 0),
+		Attempts:          1,
+		MaxAttempts:       5,
+		VisibilityTimeout: time.Minute,
+		LeaseID:           "lease-1",
+		Metadata:          map[string]string{"traceparent": "00-x-y-01"},
+	}
+
+	var buf bytes.Buffer
+	if err := (protobufCodec{}).Encode(&buf, task); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	var decoded Task
+	if err := (protobufCodec{}).Decode(&buf, &decoded); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if decoded.ID != task.ID || decoded.Topic != task.Topic || decoded.Status != task.Status ||
+		decoded.Attempts != task.Attempts || decoded.MaxAttempts != task.MaxAttempts ||
+		decoded.VisibilityTimeout != task.VisibilityTimeout || decoded.LeaseID != task.LeaseID ||
+		!decoded.Timestamp.Equal(task.Timestamp) || !decoded.SubmitTime.Equal(task.SubmitTime) ||
+		decoded.Metadata["traceparent"] != task.Metadata["traceparent"] {
+		t.Errorf("round-tripped task = %+v, want %+v", decoded, task)
+	}
+}
+
+func TestProtobufCodecUnsupportedType(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (protobufCodec{}).Encode(&buf, map[string]string{"id": "x"}); err == nil {
+		t.Error("expected an error encoding an unsupported type, got nil")
+	}
+}
@@ -1,64 +1,185 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 // Task represents a task with an ID, topic, and input data.
 type Task struct {
-	ID        string      `json:"id"`
-	Topic     string      `json:"topic"`
-	Input     interface{} `json:"input"`
-	Status    string      `json:"status"`    // "new", "pending", "completed"
-	Timestamp time.Time   `json:"timestamp"` // Time when the task was retrieved
+	ID                string            `json:"id" msgpack:"id"`
+	Topic             string            `json:"topic" msgpack:"topic"`
+	Input             interface{}       `json:"input" msgpack:"input"`
+	Status            string            `json:"status" msgpack:"status"`                         // "new", "pending", "completed"
+	Timestamp         time.Time         `json:"timestamp" msgpack:"timestamp"`                   // Time the task was last (re)reserved
+	SubmitTime        time.Time         `json:"submit_time" msgpack:"submit_time"`               // Time the task was first submitted; used for latency metrics
+	Attempts          int               `json:"attempts" msgpack:"attempts"`                     // Number of times this task has been reserved and lost
+	MaxAttempts       int               `json:"max_attempts" msgpack:"max_attempts"`             // Attempts allowed before the task moves to its dead-letter topic
+	VisibilityTimeout time.Duration     `json:"visibility_timeout" msgpack:"visibility_timeout"` // How long a reservation is honored before it's reclaimable
+	LeaseID           string            `json:"lease_id,omitempty" msgpack:"lease_id,omitempty"` // Set while Status is "pending"; must match to complete, nack, or heartbeat
+	Metadata          map[string]string `json:"metadata,omitempty" msgpack:"metadata,omitempty"` // Carries the submitter's trace context so a worker can link its span back to it
 }
 
 // Result represents the output of a processed task.
 type Result struct {
-	ID     string      `json:"id"`
-	Output interface{} `json:"output"`
+	ID      string      `json:"id" msgpack:"id"`
+	Output  interface{} `json:"output" msgpack:"output"`
+	LeaseID string      `json:"lease_id" msgpack:"lease_id"` // Must match the task's current LeaseID or the result is rejected
 }
 
-// taskStore holds the submitted tasks.
-var taskStore = make(map[string]Task)
+// submitResponse is the body returned by handleTaskSubmit.
+type submitResponse struct {
+	ID string `json:"id" msgpack:"id"`
+}
 
-// resultStore holds the results of processed tasks.
-var resultStore = make(map[string]Result)
+// Defaults applied to tasks that don't specify their own retry/visibility
+// settings at submission time.
+const (
+	defaultMaxAttempts       = 5
+	defaultVisibilityTimeout = time.Hour
+)
 
-// mutex for concurrent access to the stores.
-var storeMutex = &sync.Mutex{}
+// dlqSuffix is appended to a task's topic when it exhausts MaxAttempts, so
+// dead-lettered tasks land on a separate, explicitly-named queue instead of
+// silently vanishing.
+const dlqSuffix = ".dlq"
+
+// store holds the submitted tasks and their results. It defaults to an
+// in-memory store and is replaced in main() based on STORE_BACKEND.
+var store Store = newMemoryStore()
+
+// taskWaiters holds per-topic subscriber channels used to deliver tasks to
+// long-polling or streaming workers without them having to hot-poll
+// handleRetrieveTask. Access is guarded by waitersMutex, which is distinct
+// from submitReserveMu so notifying a waiter never has to reason about
+// recursive locking of the task store.
+var taskWaiters = make(map[string][]chan Task)
+var waitersMutex = &sync.Mutex{}
+
+// submitReserveMu serializes a submit's store-write-plus-waiter-handoff
+// against a retrieval's waiter-registration-plus-reservation-scan, so the two
+// can never interleave and deliver the same just-submitted task to two
+// callers: one via the immediate HTTP response from handleTaskSubmit's
+// notifyWaiters handoff, another via a concurrent handleRetrieveTask's
+// store.ReserveTask scan. Each Store implementation still guards its own
+// storage internally; this only protects the handoff sequence above it.
+var submitReserveMu = &sync.Mutex{}
 
 var tracer = otel.GetTracerProvider().Tracer("TaskServer")
 
+// registerWaiter adds a new subscriber channel for topic and returns it. The
+// caller must eventually call unregisterWaiter, even after receiving a task,
+// so the slice doesn't accumulate stale channels.
+func registerWaiter(topic string) chan Task {
+	ch := make(chan Task, 1)
+	waitersMutex.Lock()
+	taskWaiters[topic] = append(taskWaiters[topic], ch)
+	waitersMutex.Unlock()
+	return ch
+}
+
+// unregisterWaiter removes ch from topic's subscriber list, if still present.
+func unregisterWaiter(topic string, ch chan Task) {
+	waitersMutex.Lock()
+	defer waitersMutex.Unlock()
+	waiters := taskWaiters[topic]
+	for i, c := range waiters {
+		if c == ch {
+			taskWaiters[topic] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+}
+
+// notifyWaiters hands task to at most one subscriber of topic, if any are
+// waiting, so each task is only ever reserved for a single recipient. It
+// reports whether a waiter received the task.
+func notifyWaiters(topic string, task Task) bool {
+	waitersMutex.Lock()
+	defer waitersMutex.Unlock()
+	for len(taskWaiters[topic]) > 0 {
+		ch := taskWaiters[topic][0]
+		taskWaiters[topic] = taskWaiters[topic][1:]
+		select {
+		case ch <- task:
+			return true
+		default:
+			// Subscriber already gave up (timed out or disconnected); try the next one.
+		}
+	}
+	return false
+}
+
+// linkSubmitterTrace records the trace the task was submitted under as
+// attributes on span, if task.Metadata carries one. This is recorded as
+// attributes rather than a span link because the retrieving worker's span
+// doesn't happen-before or happen-after the submitter's in any useful sense -
+// they're two different traces that happen to share a task - but a worker's
+// own backend can still correlate the two traces from these attributes.
+func linkSubmitterTrace(span oteltrace.Span, task Task) {
+	if len(task.Metadata) == 0 {
+		return
+	}
+	submitCtx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(task.Metadata))
+	if sc := oteltrace.SpanContextFromContext(submitCtx); sc.IsValid() {
+		span.SetAttributes(
+			attribute.String("workpluck.submitter_trace_id", sc.TraceID().String()),
+			attribute.String("workpluck.submitter_span_id", sc.SpanID().String()),
+		)
+	}
+}
+
+// initTracer sets up the global TracerProvider. If OTEL_EXPORTER_OTLP_ENDPOINT
+// is set, spans are batched and exported there over OTLP/HTTP; otherwise the
+// provider has no exporter and spans are created but go nowhere, same as
+// before OTLP support existed.
 func initTracer() {
-	// exp, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
-	// if err != nil {
-	// 	log.Fatalf("Failed to initialize stdouttrace exporter: %v", err)
-	// }
-	tp := trace.NewTracerProvider(
-		// trace.WithBatcher(exp),
+	opts := []trace.TracerProviderOption{
 		trace.WithResource(resource.NewWithAttributes(
 			semconv.SchemaURL,
 			attribute.String("service.name", "TaskService"),
 		)),
-	)
+	}
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		// otlptracehttp.New reads OTEL_EXPORTER_OTLP_ENDPOINT (and the other
+		// standard OTEL_EXPORTER_OTLP_* vars) itself, so no explicit option
+		// is needed here beyond deciding whether to export at all.
+		exp, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to initialize OTLP exporter: %v", err)
+		}
+		opts = append(opts, trace.WithBatcher(exp))
+	}
+
+	tp := trace.NewTracerProvider(opts...)
 	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 }
 
 func handleTaskSubmit(w http.ResponseWriter, r *http.Request) {
 	log.Println("handleTaskSubmit called")
-	_, span := tracer.Start(r.Context(), "handleTaskSubmit")
+	ctx, span := tracer.Start(r.Context(), "handleTaskSubmit")
 	defer span.End()
 
 	if r.Method != http.MethodPost {
@@ -69,23 +190,85 @@ func handleTaskSubmit(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var task Task
-	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+	if err := decodeBody(r, &task); err != nil {
 		log.Printf("Error decoding task: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		span.RecordError(err)
 		return
 	}
 
+	schema, haveSchema := lookupTopicSchema(task.Topic)
+	if !haveSchema && strictTopics {
+		log.Printf("Rejecting submission for unregistered topic: %s", task.Topic)
+		http.Error(w, "Topic is not registered", http.StatusUnprocessableEntity)
+		span.AddEvent("Unregistered topic")
+		return
+	}
+	if haveSchema {
+		errs, err := validateAgainstSchema(schema.InputSchema, task.Input)
+		if err != nil {
+			log.Printf("Error validating task input: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			span.RecordError(err)
+			return
+		}
+		if len(errs) > 0 {
+			log.Printf("Task input failed validation for topic %s: %v", task.Topic, errs)
+			writeValidationErrors(w, errs)
+			span.AddEvent("Input validation failed")
+			return
+		}
+	}
+
 	task.ID = uuid.New().String()
 	task.Status = "new"
 	task.Timestamp = time.Now()
+	task.SubmitTime = task.Timestamp
+	// Apply defaults here, not just inside Store.SubmitTask, so the
+	// pendingTask copy handed straight to a long-poll/SSE waiter below
+	// already has them: otherwise a waiter-delivered task reports
+	// MaxAttempts=0/VisibilityTimeout=0 even though the stored copy has the
+	// real defaults, leaving a worker's heartbeat loop with nothing to do.
+	task = applyTaskDefaults(task)
+
+	// Stash the submitter's trace context in Metadata so that whichever
+	// worker eventually retrieves this task can link its own span back to
+	// this one, even though the two are connected through the store rather
+	// than a direct call.
+	if task.Metadata == nil {
+		task.Metadata = make(map[string]string)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(task.Metadata))
+
+	tasksSubmitted.WithLabelValues(task.Topic).Inc()
+
+	// SubmitTask, the waiter handoff, and MarkPending must run as one unit:
+	// see submitReserveMu's doc comment for why a concurrent
+	// handleRetrieveTask could otherwise reserve this task out from under the
+	// waiter it was just handed to.
+	submitReserveMu.Lock()
+	if err := store.SubmitTask(task); err != nil {
+		submitReserveMu.Unlock()
+		log.Printf("Error submitting task: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
 
-	storeMutex.Lock()
-	taskStore[task.ID] = task
-	storeMutex.Unlock()
+	pendingTask := task
+	pendingTask.Status = "pending"
+	pendingTask.Timestamp = time.Now()
+	pendingTask.LeaseID = uuid.New().String()
+	if notifyWaiters(task.Topic, pendingTask) {
+		if err := store.MarkPending(task.ID, pendingTask.LeaseID, pendingTask.Timestamp); err != nil {
+			log.Printf("Error marking task pending: %v", err)
+			span.RecordError(err)
+		}
+	}
+	submitReserveMu.Unlock()
 
 	w.WriteHeader(http.StatusCreated)
-	err := json.NewEncoder(w).Encode(map[string]string{"id": task.ID})
+	err := encodeResponse(w, r, submitResponse{ID: task.ID})
 	if err != nil {
 		log.Printf("Error encoding response: %v", err)
 		span.RecordError(err)
@@ -113,27 +296,69 @@ func handleRetrieveTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	storeMutex.Lock()
-	defer storeMutex.Unlock()
-
-	currentTime := time.Now()
-	for id, task := range taskStore {
-		if task.Topic == topic && (task.Status == "new" || (task.Status == "pending" && currentTime.Sub(task.Timestamp) > time.Hour)) {
-			task.Status = "pending"
-			task.Timestamp = currentTime
-			taskStore[id] = task
-			err := json.NewEncoder(w).Encode(task)
-			if err != nil {
-				log.Printf("Error encoding task: %v", err)
-				span.RecordError(err)
-			}
-			log.Printf("Task retrieved: %s", task.ID)
+	var waitDuration time.Duration
+	if waitParam := r.URL.Query().Get("wait"); waitParam != "" {
+		d, err := time.ParseDuration(waitParam)
+		if err != nil {
+			log.Printf("Invalid wait duration in handleRetrieveTask: %v", err)
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			span.RecordError(err)
 			return
 		}
+		waitDuration = d
+	}
+
+	// Register as a waiter and attempt ReserveTask as one unit, guarded by
+	// submitReserveMu, so a task submitted concurrently with the scan below
+	// is still guaranteed to reach either this call's ReserveTask or its
+	// waiter channel, never both (see submitReserveMu's doc comment).
+	submitReserveMu.Lock()
+	ch := registerWaiter(topic)
+	task, found, err := store.ReserveTask(topic)
+	submitReserveMu.Unlock()
+	if err != nil {
+		unregisterWaiter(topic, ch)
+		log.Printf("Error reserving task: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
+	if found {
+		unregisterWaiter(topic, ch)
+		linkSubmitterTrace(span, task)
+		if err := encodeResponse(w, r, task); err != nil {
+			log.Printf("Error encoding task: %v", err)
+			span.RecordError(err)
+		}
+		log.Printf("Task retrieved: %s", task.ID)
+		return
+	}
+
+	if waitDuration <= 0 {
+		unregisterWaiter(topic, ch)
+		w.WriteHeader(http.StatusNoContent)
+		log.Println("No task available in handleRetrieveTask")
+		return
 	}
+	defer unregisterWaiter(topic, ch)
+
+	timer := time.NewTimer(waitDuration)
+	defer timer.Stop()
 
-	w.WriteHeader(http.StatusNoContent)
-	log.Println("No task available in handleRetrieveTask")
+	select {
+	case task := <-ch:
+		linkSubmitterTrace(span, task)
+		if err := encodeResponse(w, r, task); err != nil {
+			log.Printf("Error encoding task: %v", err)
+			span.RecordError(err)
+		}
+		log.Printf("Task delivered to long poll: %s", task.ID)
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		log.Println("Long poll timed out in handleRetrieveTask")
+	case <-r.Context().Done():
+		log.Println("Long poll cancelled by client in handleRetrieveTask")
+	}
 }
 
 func handleSubmitResult(w http.ResponseWriter, r *http.Request) {
@@ -149,27 +374,59 @@ func handleSubmitResult(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var result Result
-	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+	if err := decodeBody(r, &result); err != nil {
 		log.Printf("Error decoding result: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		span.RecordError(err)
 		return
 	}
 
-	storeMutex.Lock()
-	task, taskExists := taskStore[result.ID]
-	if !taskExists {
-		storeMutex.Unlock()
+	// Looked up before CompleteTask purely to label the completion metrics
+	// below by topic and measure submit-to-complete latency, and to find the
+	// topic's schema for output validation; CompleteTask itself re-checks the
+	// lease against the current row.
+	task, _, _ := store.GetTask(result.ID)
+
+	if schema, ok := lookupTopicSchema(task.Topic); ok {
+		errs, err := validateAgainstSchema(schema.OutputSchema, result.Output)
+		if err != nil {
+			log.Printf("Error validating result output: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			span.RecordError(err)
+			return
+		}
+		if len(errs) > 0 {
+			log.Printf("Result output failed validation for topic %s: %v", task.Topic, errs)
+			writeValidationErrors(w, errs)
+			span.AddEvent("Output validation failed")
+			return
+		}
+	}
+
+	completed, err := store.CompleteTask(result)
+	if errors.Is(err, ErrLeaseMismatch) {
+		log.Printf("Stale lease for task %s", result.ID)
+		http.Error(w, err.Error(), http.StatusConflict)
+		span.AddEvent("Lease mismatch")
+		return
+	}
+	if err != nil {
+		log.Printf("Error completing task: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
+	if !completed {
 		log.Printf("Task does not exist: %s", result.ID)
 		http.Error(w, "Task does not exist", http.StatusNotFound)
 		span.AddEvent("Task not found")
 		return
 	}
 
-	task.Status = "completed"
-	taskStore[result.ID] = task
-	resultStore[result.ID] = result
-	storeMutex.Unlock()
+	tasksCompleted.WithLabelValues(task.Topic).Inc()
+	if !task.SubmitTime.IsZero() {
+		taskLatency.WithLabelValues(task.Topic).Observe(time.Since(task.SubmitTime).Seconds())
+	}
 
 	w.WriteHeader(http.StatusOK)
 	log.Printf("Result submitted for task: %s", result.ID)
@@ -195,12 +452,13 @@ func handleGetResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	storeMutex.Lock()
-	defer storeMutex.Unlock()
-
-	result, resultExists := resultStore[id]
-	_, taskExists := taskStore[id]
-
+	_, taskExists, err := store.GetTask(id)
+	if err != nil {
+		log.Printf("Error looking up task: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
 	if !taskExists {
 		log.Printf("Task not found: %s", id)
 		http.Error(w, "Task not found", http.StatusNotFound)
@@ -208,20 +466,211 @@ func handleGetResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	result, resultExists, err := store.GetResult(id)
+	if err != nil {
+		log.Printf("Error looking up result: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
 	if !resultExists {
 		w.WriteHeader(http.StatusAccepted)
 		log.Printf("Task exists but result not completed: %s", id)
 		return
 	}
 
-	err := json.NewEncoder(w).Encode(result)
-	if err != nil {
+	if err := encodeResponse(w, r, result); err != nil {
 		log.Printf("Error encoding result: %v", err)
 		span.RecordError(err)
 	}
 	log.Printf("Result retrieved for task: %s", result.ID)
 }
 
+// handleTaskStream upgrades the connection to Server-Sent Events and pushes
+// newly-submitted tasks for topic to this subscriber as they arrive. Each
+// pushed task is reserved for exactly one stream or long poll via the same
+// notifyWaiters mechanism, so subscribers never race each other for a task.
+func handleTaskStream(w http.ResponseWriter, r *http.Request) {
+	log.Println("handleTaskStream called")
+	_, span := tracer.Start(r.Context(), "handleTaskStream")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		log.Println("Invalid method in handleTaskStream")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		span.AddEvent("Invalid method")
+		return
+	}
+
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		log.Println("Topic is required in handleTaskStream")
+		http.Error(w, "Topic is required", http.StatusBadRequest)
+		span.AddEvent("Missing topic")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming unsupported in handleTaskStream")
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		span.AddEvent("Streaming unsupported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		ch := registerWaiter(topic)
+		select {
+		case task := <-ch:
+			linkSubmitterTrace(span, task)
+			data, err := json.Marshal(task)
+			if err != nil {
+				log.Printf("Error encoding streamed task: %v", err)
+				span.RecordError(err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			log.Printf("Task streamed: %s", task.ID)
+		case <-r.Context().Done():
+			unregisterWaiter(topic, ch)
+			log.Println("Task stream closed by client")
+			return
+		}
+	}
+}
+
+// leaseRequest is the body expected by handleTaskNack and
+// handleTaskHeartbeat: a task ID and the lease the caller believes it holds.
+type leaseRequest struct {
+	ID      string `json:"id" msgpack:"id"`
+	LeaseID string `json:"lease_id" msgpack:"lease_id"`
+}
+
+// handleTaskNack lets a worker release a task early, before its visibility
+// timeout elapses, so it can be retried sooner by another worker (or
+// dead-lettered immediately if this was the task's last allowed attempt).
+func handleTaskNack(w http.ResponseWriter, r *http.Request) {
+	log.Println("handleTaskNack called")
+	_, span := tracer.Start(r.Context(), "handleTaskNack")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		log.Println("Invalid method in handleTaskNack")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		span.AddEvent("Invalid method")
+		return
+	}
+
+	var req leaseRequest
+	if err := decodeBody(r, &req); err != nil {
+		log.Printf("Error decoding nack request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		span.RecordError(err)
+		return
+	}
+
+	ok, err := store.NackTask(req.ID, req.LeaseID)
+	if errors.Is(err, ErrLeaseMismatch) {
+		log.Printf("Stale lease for task %s", req.ID)
+		http.Error(w, err.Error(), http.StatusConflict)
+		span.AddEvent("Lease mismatch")
+		return
+	}
+	if err != nil {
+		log.Printf("Error nacking task: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
+	if !ok {
+		log.Printf("Task does not exist: %s", req.ID)
+		http.Error(w, "Task does not exist", http.StatusNotFound)
+		span.AddEvent("Task not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	log.Printf("Task nacked: %s", req.ID)
+}
+
+// handleTaskHeartbeat lets a worker still processing a task extend its
+// visibility deadline so the sweeper doesn't reclaim it out from under them.
+func handleTaskHeartbeat(w http.ResponseWriter, r *http.Request) {
+	log.Println("handleTaskHeartbeat called")
+	_, span := tracer.Start(r.Context(), "handleTaskHeartbeat")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		log.Println("Invalid method in handleTaskHeartbeat")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		span.AddEvent("Invalid method")
+		return
+	}
+
+	var req leaseRequest
+	if err := decodeBody(r, &req); err != nil {
+		log.Printf("Error decoding heartbeat request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		span.RecordError(err)
+		return
+	}
+
+	ok, err := store.HeartbeatTask(req.ID, req.LeaseID, time.Now())
+	if errors.Is(err, ErrLeaseMismatch) {
+		log.Printf("Stale lease for task %s", req.ID)
+		http.Error(w, err.Error(), http.StatusConflict)
+		span.AddEvent("Lease mismatch")
+		return
+	}
+	if err != nil {
+		log.Printf("Error heartbeating task: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		span.RecordError(err)
+		return
+	}
+	if !ok {
+		log.Printf("Task does not exist: %s", req.ID)
+		http.Error(w, "Task does not exist", http.StatusNotFound)
+		span.AddEvent("Task not found")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	log.Printf("Task heartbeat extended: %s", req.ID)
+}
+
+// runLeaseSweeper periodically reclaims tasks whose visibility timeout has
+// elapsed, re-queuing them or moving them to their dead-letter topic once
+// they've exhausted MaxAttempts. It runs until ctx is cancelled.
+func runLeaseSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reclaimed, deadLettered, err := store.SweepExpiredLeases(time.Now())
+			if err != nil {
+				log.Printf("Error sweeping expired leases: %v", err)
+				continue
+			}
+			tasksExpired.Add(float64(reclaimed))
+			tasksFailed.Add(float64(deadLettered))
+			if reclaimed > 0 || deadLettered > 0 {
+				log.Printf("Lease sweep: reclaimed %d task(s), dead-lettered %d task(s)", reclaimed, deadLettered)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func handleTask(w http.ResponseWriter, r *http.Request) {
 	log.Println("handleTask called")
 	switch r.Method {
@@ -253,29 +702,77 @@ func handleObserve(w http.ResponseWriter, r *http.Request) {
 	_, span := tracer.Start(r.Context(), "handleObserve")
 	defer span.End()
 
-	// Print out entire contents of taskStore and resultStore
-	storeMutex.Lock()
-	defer storeMutex.Unlock()
+	// Print out entire contents of the store.
+	tasks, err := store.ListTasks()
+	if err != nil {
+		log.Printf("Error listing tasks: %v", err)
+		span.RecordError(err)
+		return
+	}
+	results, err := store.ListResults()
+	if err != nil {
+		log.Printf("Error listing results: %v", err)
+		span.RecordError(err)
+		return
+	}
 
-	for id, task := range taskStore {
-		log.Printf("Task: %s, %s, %s", id, task, task.Status)
-		w.Write([]byte("Task: " + id + ", " + task.Status + "\n"))
+	for _, task := range tasks {
+		log.Printf("Task: %s, %+v, %s", task.ID, task, task.Status)
+		w.Write([]byte("Task: " + task.ID + ", " + task.Status + "\n"))
+	}
+	for _, result := range results {
+		log.Printf("Result: %s, %+v", result.ID, result)
+		w.Write([]byte("Result: " + result.ID + ", " + result.ID + "\n"))
 	}
-	for id, result := range resultStore {
-		log.Printf("Result: %s, %s", id, result)
-		w.Write([]byte("Result: " + id + ", " + result.ID + "\n"))
+}
+
+// sweepIntervalFromEnv reads SWEEP_INTERVAL (a time.ParseDuration string,
+// e.g. "30s") or falls back to a sensible default.
+func sweepIntervalFromEnv() time.Duration {
+	if raw := os.Getenv("SWEEP_INTERVAL"); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil {
+			return d
+		}
+		if secs, err := strconv.Atoi(raw); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		log.Printf("Invalid SWEEP_INTERVAL %q, using default", raw)
 	}
+	return time.Minute
 }
 
 func main() {
 	initTracer()
-	log.Println("Server is starting on port 8080...")
-	http.HandleFunc("/task", handleTask)
-	http.HandleFunc("/result", handleResult)
-	http.HandleFunc("/observe", handleObserve)
+	strictTopics, _ = strconv.ParseBool(os.Getenv("STRICT_TOPICS"))
 
-	err := http.ListenAndServe(":8080", nil)
+	backendStore, err := newStoreFromEnv()
 	if err != nil {
+		log.Fatalf("Failed to initialize store: %v", err)
+	}
+	store = backendStore
+
+	sweepCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	go runLeaseSweeper(sweepCtx, sweepIntervalFromEnv())
+
+	log.Println("Server is starting on port 8080...")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task", handleTask)
+	mux.HandleFunc("/tasks/stream", handleTaskStream)
+	mux.HandleFunc("/task/nack", handleTaskNack)
+	mux.HandleFunc("/task/heartbeat", handleTaskHeartbeat)
+	mux.HandleFunc("/result", handleResult)
+	mux.HandleFunc("/observe", handleObserve)
+	mux.HandleFunc("/topics", handleTopics)
+	mux.HandleFunc("/topics/", handleTopicSchema)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Wrapping the whole mux means every request gets a span started for it
+	// automatically, on top of (as a parent of) the manual tracer.Start calls
+	// each handler already makes.
+	handler := otelhttp.NewHandler(mux, "workpluck")
+
+	if err := http.ListenAndServe(":8080", handler); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
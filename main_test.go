@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/maccam912/workpluck/pkg/worker"
 )
 
 // TestHandleTaskSubmit tests the task submission handler.
@@ -40,10 +44,10 @@ func TestHandleTaskSubmit(t *testing.T) {
 
 // TestHandleRetrieveTask tests the task retrieval handler.
 func TestHandleRetrieveTask(t *testing.T) {
-	// Clear and pre-populate taskStore with a task
-	taskStore = make(map[string]Task)
+	// Clear and pre-populate the store with a task
+	store = newMemoryStore()
 	testTask := Task{ID: "test-id", Topic: "test", Input: map[string]string{"key": "value"}, Status: "new"}
-	taskStore[testTask.ID] = testTask
+	store.SubmitTask(testTask)
 
 	// Mock a request to retrieve the task
 	req, err := http.NewRequest("GET", "/task?topic=test", nil)
@@ -73,11 +77,10 @@ func TestHandleRetrieveTask(t *testing.T) {
 
 // TestHandleSubmitResult tests the result submission handler.
 func TestHandleSubmitResult(t *testing.T) {
-	// Clear taskStore and resultStore, then pre-populate taskStore with a task
-	taskStore = make(map[string]Task)
-	resultStore = make(map[string]Result)
+	// Clear the store, then pre-populate it with a task
+	store = newMemoryStore()
 	testTask := Task{ID: "test-id", Topic: "test", Input: map[string]string{"key": "value"}, Status: "pending"}
-	taskStore[testTask.ID] = testTask
+	store.SubmitTask(testTask)
 
 	// Mock a request to submit a result
 	result := Result{ID: testTask.ID, Output: map[string]string{"result": "success"}}
@@ -98,7 +101,10 @@ func TestHandleSubmitResult(t *testing.T) {
 	}
 
 	// Verify task status is updated
-	updatedTask, exists := taskStore[testTask.ID]
+	updatedTask, exists, err := store.GetTask(testTask.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !exists || updatedTask.Status != "completed" {
 		t.Errorf("task status was not updated correctly: got %v, want completed", updatedTask.Status)
 	}
@@ -106,9 +112,10 @@ func TestHandleSubmitResult(t *testing.T) {
 
 // TestHandleGetResult tests the task result retrieval handler.
 func TestHandleGetResult(t *testing.T) {
-	// Pre-populate resultStore with a result
+	// Pre-populate the result store; the "test-id" task itself was left
+	// behind by TestHandleSubmitResult above.
 	testResult := Result{ID: "test-id", Output: map[string]string{"result": "success"}}
-	resultStore[testResult.ID] = testResult
+	store.CompleteTask(testResult)
 
 	// Mock a request to retrieve the result
 	req, err := http.NewRequest("GET", "/result?id=test-id", nil)
@@ -136,6 +143,237 @@ func TestHandleGetResult(t *testing.T) {
 	}
 }
 
+// TestHandleRetrieveTaskLongPoll verifies that a long poll started before a
+// matching task is submitted is woken up and delivered the task instead of
+// waiting out the full timeout.
+func TestHandleRetrieveTaskLongPoll(t *testing.T) {
+	store = newMemoryStore()
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "/task?topic=longpoll&wait=2s", nil)
+		rr := httptest.NewRecorder()
+		handleRetrieveTask(rr, req)
+		done <- rr
+	}()
+
+	// Give the long poll time to register its waiter before the task arrives.
+	time.Sleep(50 * time.Millisecond)
+
+	submitReq, _ := http.NewRequest("POST", "/task", bytes.NewBuffer([]byte(`{"topic": "longpoll", "input": {"data": "test"}}`)))
+	submitRr := httptest.NewRecorder()
+	handleTaskSubmit(submitRr, submitReq)
+
+	select {
+	case rr := <-done:
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var response Task
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Topic != "longpoll" || response.Status != "pending" {
+			t.Errorf("long poll returned unexpected task: got topic %v status %v", response.Topic, response.Status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("long poll did not return after task submission")
+	}
+}
+
+// TestHandleRetrieveTaskLongPollAppliesDefaults is a regression test for a
+// waiter-delivered task reporting MaxAttempts=0/VisibilityTimeout=0: the
+// pendingTask copy handed to a long-poll waiter used to be built from the
+// pre-default task, while the store's own copy had the real defaults
+// applied. A worker that relies on VisibilityTimeout to pace its heartbeat
+// loop would never heartbeat and would lose the lease out from under it.
+func TestHandleRetrieveTaskLongPollAppliesDefaults(t *testing.T) {
+	store = newMemoryStore()
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "/task?topic=longpoll-defaults&wait=2s", nil)
+		rr := httptest.NewRecorder()
+		handleRetrieveTask(rr, req)
+		done <- rr
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	submitReq, _ := http.NewRequest("POST", "/task", bytes.NewBuffer([]byte(`{"topic": "longpoll-defaults", "input": {"data": "test"}}`)))
+	submitRr := httptest.NewRecorder()
+	handleTaskSubmit(submitRr, submitReq)
+
+	select {
+	case rr := <-done:
+		var response Task
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.MaxAttempts != defaultMaxAttempts || response.VisibilityTimeout != defaultVisibilityTimeout {
+			t.Errorf("waiter-delivered task has MaxAttempts=%d VisibilityTimeout=%v, want %d/%v",
+				response.MaxAttempts, response.VisibilityTimeout, defaultMaxAttempts, defaultVisibilityTimeout)
+		}
+
+		stored, found, err := store.GetTask(response.ID)
+		if err != nil || !found {
+			t.Fatalf("GetTask: found=%v err=%v", found, err)
+		}
+		if stored.MaxAttempts != response.MaxAttempts || stored.VisibilityTimeout != response.VisibilityTimeout {
+			t.Errorf("waiter-delivered task %+v disagrees with stored task %+v", response, stored)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("long poll did not return after task submission")
+	}
+}
+
+// TestHandleRetrieveTaskLongPollTimeout verifies that a long poll with no
+// matching task returns 204 once the wait duration elapses.
+func TestHandleRetrieveTaskLongPollTimeout(t *testing.T) {
+	store = newMemoryStore()
+
+	req, _ := http.NewRequest("GET", "/task?topic=empty&wait=50ms", nil)
+	rr := httptest.NewRecorder()
+	handleRetrieveTask(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+}
+
+// TestSubmitAndRetrieveRaceNoDoubleDelivery is a regression test for a race
+// where a concurrent short-poll handleRetrieveTask call could reserve a task
+// in the window between handleTaskSubmit's store.SubmitTask and its
+// notifyWaiters/MarkPending handoff, delivering the same task (with two
+// different LeaseIDs) to both the waiting long-poller and the short-poller.
+// See submitReserveMu's doc comment.
+func TestSubmitAndRetrieveRaceNoDoubleDelivery(t *testing.T) {
+	const iterations = 200
+	for i := 0; i < iterations; i++ {
+		store = newMemoryStore()
+
+		longPollDone := make(chan *Task, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", "/task?topic=race&wait=1s", nil)
+			rr := httptest.NewRecorder()
+			handleRetrieveTask(rr, req)
+			if rr.Code != http.StatusOK {
+				longPollDone <- nil
+				return
+			}
+			var task Task
+			json.Unmarshal(rr.Body.Bytes(), &task)
+			longPollDone <- &task
+		}()
+
+		// Give the long poll a chance to register its waiter, then race a
+		// submit against a short-poll retrieval for the same topic.
+		time.Sleep(time.Millisecond)
+
+		submitReq, _ := http.NewRequest("POST", "/task", bytes.NewBuffer([]byte(`{"topic": "race", "input": {}}`)))
+		submitRr := httptest.NewRecorder()
+		handleTaskSubmit(submitRr, submitReq)
+
+		shortPollReq, _ := http.NewRequest("GET", "/task?topic=race", nil)
+		shortPollRr := httptest.NewRecorder()
+		handleRetrieveTask(shortPollRr, shortPollReq)
+
+		longPollTask := <-longPollDone
+
+		delivered := 0
+		var leases []string
+		if longPollTask != nil {
+			delivered++
+			leases = append(leases, longPollTask.LeaseID)
+		}
+		if shortPollRr.Code == http.StatusOK {
+			var task Task
+			json.Unmarshal(shortPollRr.Body.Bytes(), &task)
+			delivered++
+			leases = append(leases, task.LeaseID)
+		}
+
+		if delivered > 1 {
+			t.Fatalf("iteration %d: task delivered to both the long poll and the short poll, leases %v", i, leases)
+		}
+	}
+}
+
+// TestHandleTaskNack verifies that nacking a task requeues it as "new" so it
+// can be reserved again right away, instead of waiting out its visibility
+// timeout.
+func TestHandleTaskNack(t *testing.T) {
+	store = newMemoryStore()
+	testTask := Task{ID: "nack-id", Topic: "nack-topic", Status: "new", Timestamp: time.Now()}
+	store.SubmitTask(testTask)
+
+	reserved, found, err := store.ReserveTask("nack-topic")
+	if err != nil || !found {
+		t.Fatalf("ReserveTask: found=%v err=%v", found, err)
+	}
+
+	nackJSON, _ := json.Marshal(leaseRequest{ID: reserved.ID, LeaseID: reserved.LeaseID})
+	req, _ := http.NewRequest("POST", "/task/nack", bytes.NewBuffer(nackJSON))
+	rr := httptest.NewRecorder()
+	handleTaskNack(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	got, _, _ := store.GetTask(reserved.ID)
+	if got.Status != "new" || got.Attempts != 1 {
+		t.Errorf("task was not requeued correctly: got status %v attempts %v", got.Status, got.Attempts)
+	}
+}
+
+// TestHandleTaskNackLeaseMismatch verifies that nacking with a stale lease is
+// rejected instead of disrupting whoever holds the current reservation.
+func TestHandleTaskNackLeaseMismatch(t *testing.T) {
+	store = newMemoryStore()
+	testTask := Task{ID: "nack-mismatch-id", Topic: "nack-topic", Status: "new", Timestamp: time.Now()}
+	store.SubmitTask(testTask)
+	if _, _, err := store.ReserveTask("nack-topic"); err != nil {
+		t.Fatalf("ReserveTask: %v", err)
+	}
+
+	nackJSON, _ := json.Marshal(leaseRequest{ID: testTask.ID, LeaseID: "wrong-lease"})
+	req, _ := http.NewRequest("POST", "/task/nack", bytes.NewBuffer(nackJSON))
+	rr := httptest.NewRecorder()
+	handleTaskNack(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}
+
+// TestHandleTaskHeartbeat verifies that heartbeating a reserved task succeeds
+// and leaves it pending under the same lease.
+func TestHandleTaskHeartbeat(t *testing.T) {
+	store = newMemoryStore()
+	testTask := Task{ID: "heartbeat-id", Topic: "heartbeat-topic", Status: "new", Timestamp: time.Now()}
+	store.SubmitTask(testTask)
+
+	reserved, found, err := store.ReserveTask("heartbeat-topic")
+	if err != nil || !found {
+		t.Fatalf("ReserveTask: found=%v err=%v", found, err)
+	}
+
+	heartbeatJSON, _ := json.Marshal(leaseRequest{ID: reserved.ID, LeaseID: reserved.LeaseID})
+	req, _ := http.NewRequest("POST", "/task/heartbeat", bytes.NewBuffer(heartbeatJSON))
+	rr := httptest.NewRecorder()
+	handleTaskHeartbeat(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	got, _, _ := store.GetTask(reserved.ID)
+	if got.Status != "pending" || got.LeaseID != reserved.LeaseID {
+		t.Errorf("heartbeat changed task unexpectedly: got status %v lease %v", got.Status, got.LeaseID)
+	}
+}
+
 // TestEndToEnd tests the entire flow from task submission to result retrieval.
 func TestEndToEnd(t *testing.T) {
 	// Submit a task
@@ -155,7 +393,10 @@ func TestEndToEnd(t *testing.T) {
 	retrieveRr := httptest.NewRecorder()
 	handleRetrieveTask(retrieveRr, retrieveReq)
 
-	submitResultReq, _ := http.NewRequest("POST", "/result", bytes.NewBuffer([]byte(`{"id": "`+taskID+`", "output": {"result": "success"}}`)))
+	var retrievedTask Task
+	json.Unmarshal(retrieveRr.Body.Bytes(), &retrievedTask)
+
+	submitResultReq, _ := http.NewRequest("POST", "/result", bytes.NewBuffer([]byte(`{"id": "`+taskID+`", "output": {"result": "success"}, "lease_id": "`+retrievedTask.LeaseID+`"}`)))
 	submitResultRr := httptest.NewRecorder()
 	handleSubmitResult(submitResultRr, submitResultReq)
 
@@ -172,3 +413,56 @@ func TestEndToEnd(t *testing.T) {
 		t.Fatalf("Retrieving result failed, got status code %d", getResultRr.Code)
 	}
 }
+
+// newTestServer starts an httptest.Server wired to the real handlers this
+// package registers in main, so SDK-level tests exercise the same
+// reservation/locking/default-filling logic the production server runs,
+// rather than a hand-rolled stand-in.
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task", handleTask)
+	mux.HandleFunc("/tasks/stream", handleTaskStream)
+	mux.HandleFunc("/task/nack", handleTaskNack)
+	mux.HandleFunc("/task/heartbeat", handleTaskHeartbeat)
+	mux.HandleFunc("/result", handleResult)
+	return httptest.NewServer(mux)
+}
+
+// TestWorkerClientEndToEnd drives the real server's handlers with
+// worker.Client instead of httptest.NewRecorder, so the SDK's Submit/Run/
+// WaitResult round-trip is verified against the production reservation and
+// locking logic covered by TestSubmitAndRetrieveRaceNoDoubleDelivery and
+// store_test.go, not a simplified reimplementation of it.
+func TestWorkerClientEndToEnd(t *testing.T) {
+	store = newMemoryStore()
+
+	server := newTestServer()
+	defer server.Close()
+
+	client := &worker.Client{BaseURL: server.URL, PollWait: 200 * time.Millisecond}
+
+	id, err := client.Submit(context.Background(), "worker-e2e", map[string]string{"name": "ada"})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = client.Run(ctx, "worker-e2e", func(_ context.Context, task worker.Task) (interface{}, error) {
+			return map[string]string{"greeting": "hi " + task.Input.(map[string]interface{})["name"].(string)}, nil
+		})
+	}()
+
+	result, err := client.WaitResult(context.Background(), id)
+	if err != nil {
+		t.Fatalf("WaitResult: %v", err)
+	}
+	if result.ID != id {
+		t.Errorf("WaitResult returned result for %q, want %q", result.ID, id)
+	}
+	greeting, _ := result.Output.(map[string]interface{})["greeting"].(string)
+	if greeting != "hi ada" {
+		t.Errorf("result output = %+v, want greeting %q", result.Output, "hi ada")
+	}
+}
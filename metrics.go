@@ -0,0 +1,122 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// tasksSubmitted counts every task accepted by handleTaskSubmit, labeled
+	// by topic.
+	tasksSubmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workpluck_tasks_submitted_total",
+		Help: "Total number of tasks submitted, labeled by topic.",
+	}, []string{"topic"})
+
+	// tasksCompleted counts every task successfully completed via
+	// handleSubmitResult, labeled by topic.
+	tasksCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workpluck_tasks_completed_total",
+		Help: "Total number of tasks completed, labeled by topic.",
+	}, []string{"topic"})
+
+	// tasksFailed counts tasks the lease sweeper moved to a dead-letter topic
+	// after exhausting their MaxAttempts. It isn't labeled by topic because
+	// Store.SweepExpiredLeases only reports an aggregate count.
+	tasksFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "workpluck_tasks_failed_total",
+		Help: "Total number of tasks dead-lettered after exhausting their retry attempts.",
+	})
+
+	// tasksExpired counts tasks the lease sweeper reclaimed and requeued
+	// after their visibility timeout elapsed without being dead-lettered.
+	tasksExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "workpluck_tasks_expired_total",
+		Help: "Total number of task reservations that expired and were requeued for retry.",
+	})
+
+	// taskLatency observes the time from a task's submission to its
+	// completion, labeled by topic.
+	taskLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "workpluck_task_latency_seconds",
+		Help:    "Time from task submission to completion, labeled by topic.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic"})
+)
+
+func init() {
+	prometheus.MustRegister(tasksSubmitted, tasksCompleted, tasksFailed, tasksExpired, taskLatency, storeCollector{})
+}
+
+// storeCollector is a prometheus.Collector that derives per-topic queue
+// gauges from the current contents of store at scrape time, rather than
+// maintaining running counters that would need updating on every task state
+// transition.
+type storeCollector struct{}
+
+var (
+	queueDepthDesc = prometheus.NewDesc(
+		"workpluck_queue_depth",
+		"Number of tasks waiting to be reserved, labeled by topic.",
+		[]string{"topic"}, nil)
+	pendingCountDesc = prometheus.NewDesc(
+		"workpluck_pending_count",
+		"Number of tasks currently reserved by a worker, labeled by topic.",
+		[]string{"topic"}, nil)
+	oldestTaskAgeDesc = prometheus.NewDesc(
+		"workpluck_oldest_task_age_seconds",
+		"Age in seconds of the oldest waiting task, labeled by topic.",
+		[]string{"topic"}, nil)
+)
+
+func (storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- pendingCountDesc
+	ch <- oldestTaskAgeDesc
+}
+
+func (storeCollector) Collect(ch chan<- prometheus.Metric) {
+	tasks, err := store.ListTasks()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	type topicStats struct {
+		depth, pending int
+		oldest         time.Time
+	}
+	stats := make(map[string]*topicStats)
+	statsFor := func(topic string) *topicStats {
+		s, ok := stats[topic]
+		if !ok {
+			s = &topicStats{}
+			stats[topic] = s
+		}
+		return s
+	}
+
+	for _, task := range tasks {
+		s := statsFor(task.Topic)
+		switch task.Status {
+		case "new":
+			s.depth++
+			if s.oldest.IsZero() || task.SubmitTime.Before(s.oldest) {
+				s.oldest = task.SubmitTime
+			}
+		case "pending":
+			s.pending++
+		}
+	}
+
+	for topic, s := range stats {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(s.depth), topic)
+		ch <- prometheus.MustNewConstMetric(pendingCountDesc, prometheus.GaugeValue, float64(s.pending), topic)
+		age := 0.0
+		if !s.oldest.IsZero() {
+			age = now.Sub(s.oldest).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(oldestTaskAgeDesc, prometheus.GaugeValue, age, topic)
+	}
+}
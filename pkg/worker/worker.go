@@ -0,0 +1,371 @@
+// Package worker is a client SDK for workpluck: it submits tasks, waits for
+// results, and runs a retrieval loop that long-polls for work, invokes a
+// handler, and reports the outcome back to the server.
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var tracer = otel.GetTracerProvider().Tracer("github.com/maccam912/workpluck/pkg/worker")
+
+// Task mirrors the server's Task type. Field names and JSON tags must match
+// main.Task exactly, since the two are never compiled together.
+type Task struct {
+	ID                string            `json:"id"`
+	Topic             string            `json:"topic"`
+	Input             interface{}       `json:"input"`
+	Status            string            `json:"status"`
+	Timestamp         time.Time         `json:"timestamp"`
+	SubmitTime        time.Time         `json:"submit_time"`
+	Attempts          int               `json:"attempts"`
+	MaxAttempts       int               `json:"max_attempts"`
+	VisibilityTimeout time.Duration     `json:"visibility_timeout"`
+	LeaseID           string            `json:"lease_id,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// Result mirrors the server's Result type.
+type Result struct {
+	ID      string      `json:"id"`
+	Output  interface{} `json:"output"`
+	LeaseID string      `json:"lease_id"`
+}
+
+type submitResponse struct {
+	ID string `json:"id"`
+}
+
+type leaseRequest struct {
+	ID      string `json:"id"`
+	LeaseID string `json:"lease_id"`
+}
+
+// Handler processes a single task and returns the value to submit as its
+// result. An error causes the task to be nacked instead.
+type Handler func(ctx context.Context, task Task) (interface{}, error)
+
+// Client talks to a workpluck server.
+type Client struct {
+	// BaseURL is the server's address, e.g. "http://localhost:8080".
+	BaseURL string
+
+	// HTTPClient is used for all requests. Defaults to http.DefaultClient
+	// if left nil.
+	HTTPClient *http.Client
+
+	// HeartbeatInterval is how often Run sends a heartbeat while a handler
+	// is running. Defaults to a third of the task's VisibilityTimeout if
+	// zero.
+	HeartbeatInterval time.Duration
+
+	// PollWait is how long each long-poll request in Run blocks waiting for
+	// a task before retrying. Defaults to 30s if zero.
+	PollWait time.Duration
+
+	// Backoff configures the exponential backoff used on transient HTTP
+	// errors. Defaults are used for any zero field.
+	Backoff Backoff
+}
+
+// Backoff configures exponential backoff with jitter.
+type Backoff struct {
+	// Initial is the delay before the first retry. Defaults to 100ms.
+	Initial time.Duration
+	// Max caps the delay between retries. Defaults to 10s.
+	Max time.Duration
+	// MaxAttempts is the number of attempts before giving up, including the
+	// first. Defaults to 5.
+	MaxAttempts int
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = 100 * time.Millisecond
+	}
+	if b.Max <= 0 {
+		b.Max = 10 * time.Second
+	}
+	if b.MaxAttempts <= 0 {
+		b.MaxAttempts = 5
+	}
+	return b
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// do sends req, retrying with exponential backoff on network errors and 5xx
+// responses. A non-retryable response (2xx, 4xx) is returned as-is.
+func (c *Client) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	backoff := c.Backoff.withDefaults()
+	delay := backoff.Initial
+
+	var lastErr error
+	for attempt := 1; attempt <= backoff.MaxAttempts; attempt++ {
+		resp, err := c.httpClient().Do(req.Clone(ctx))
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("server error: %s", resp.Status)
+		} else {
+			lastErr = err
+		}
+
+		if attempt == backoff.MaxAttempts {
+			break
+		}
+
+		jitter := time.Duration(rand.Int63n(int64(delay) + 1))
+		select {
+		case <-time.After(delay + jitter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+		if delay > backoff.Max {
+			delay = backoff.Max
+		}
+	}
+	return nil, fmt.Errorf("request failed after %d attempts: %w", backoff.MaxAttempts, lastErr)
+}
+
+func (c *Client) url(path string) string {
+	return strings.TrimRight(c.BaseURL, "/") + path
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, body interface{}, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(path), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, string(respBody))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Submit posts a new task to topic and returns its ID.
+func (c *Client) Submit(ctx context.Context, topic string, input interface{}) (string, error) {
+	ctx, span := tracer.Start(ctx, "worker.Submit")
+	defer span.End()
+
+	task := Task{Topic: topic, Input: input, Metadata: make(map[string]string)}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(task.Metadata))
+
+	var resp submitResponse
+	if err := c.postJSON(ctx, "/task", task, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// WaitResult polls for id's result until it's available or ctx is done.
+func (c *Client) WaitResult(ctx context.Context, id string) (Result, error) {
+	ctx, span := tracer.Start(ctx, "worker.WaitResult")
+	defer span.End()
+
+	backoff := c.Backoff.withDefaults()
+	delay := backoff.Initial
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/result?id="+id), nil)
+		if err != nil {
+			return Result{}, err
+		}
+
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return Result{}, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			var result Result
+			err := json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			return result, err
+		}
+		resp.Body.Close()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return Result{}, ctx.Err()
+		}
+		delay *= 2
+		if delay > backoff.Max {
+			delay = backoff.Max
+		}
+	}
+}
+
+// retrieveTask long-polls /task?topic=...&wait=... and returns the task
+// delivered, if any. A nil Task with a nil error means the poll timed out
+// with nothing available.
+func (c *Client) retrieveTask(ctx context.Context, topic string, wait time.Duration) (*Task, error) {
+	query := url.Values{"topic": {topic}, "wait": {wait.String()}}
+	path := "/task?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(path), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("retrieve task: %s: %s", resp.Status, string(body))
+	}
+
+	var task Task
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (c *Client) heartbeat(ctx context.Context, task Task) error {
+	return c.postJSON(ctx, "/task/heartbeat", leaseRequest{ID: task.ID, LeaseID: task.LeaseID}, nil)
+}
+
+func (c *Client) nack(ctx context.Context, task Task) error {
+	return c.postJSON(ctx, "/task/nack", leaseRequest{ID: task.ID, LeaseID: task.LeaseID}, nil)
+}
+
+func (c *Client) submitResult(ctx context.Context, task Task, output interface{}) error {
+	return c.postJSON(ctx, "/result", Result{ID: task.ID, Output: output, LeaseID: task.LeaseID}, nil)
+}
+
+// Run long-polls topic for tasks and invokes handler for each one, until ctx
+// is cancelled. The handler's context carries a deadline matching the task's
+// visibility timeout and is linked to the submitter's span via the trace
+// context in task.Metadata. While the handler runs, Run sends periodic
+// heartbeats to keep the lease alive. On success the handler's return value
+// is posted as the task's result; on error the task is nacked so another
+// worker can retry it.
+func (c *Client) Run(ctx context.Context, topic string, handler Handler) error {
+	pollWait := c.PollWait
+	if pollWait <= 0 {
+		pollWait = 30 * time.Second
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		task, err := c.retrieveTask(ctx, topic, pollWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("worker: error retrieving task for topic %s: %v", topic, err)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+
+		c.handleTask(ctx, *task, handler)
+	}
+}
+
+// handleTask runs handler for task, heartbeating in the background, and
+// reports the outcome back to the server.
+func (c *Client) handleTask(ctx context.Context, task Task, handler Handler) {
+	handlerCtx := otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(task.Metadata))
+	handlerCtx, span := tracer.Start(handlerCtx, "worker.handle:"+task.Topic)
+	defer span.End()
+
+	if task.VisibilityTimeout > 0 {
+		var cancel context.CancelFunc
+		handlerCtx, cancel = context.WithTimeout(handlerCtx, task.VisibilityTimeout)
+		defer cancel()
+	}
+
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	defer stopHeartbeat()
+	go c.heartbeatLoop(heartbeatCtx, task)
+
+	output, err := handler(handlerCtx, task)
+	stopHeartbeat()
+
+	if err != nil {
+		span.RecordError(err)
+		if nackErr := c.nack(ctx, task); nackErr != nil {
+			log.Printf("worker: error nacking task %s: %v", task.ID, nackErr)
+		}
+		return
+	}
+
+	if err := c.submitResult(ctx, task, output); err != nil {
+		log.Printf("worker: error submitting result for task %s: %v", task.ID, err)
+		span.RecordError(err)
+	}
+}
+
+// heartbeatLoop sends heartbeats for task until ctx is done.
+func (c *Client) heartbeatLoop(ctx context.Context, task Task) {
+	interval := c.HeartbeatInterval
+	if interval <= 0 {
+		interval = task.VisibilityTimeout / 3
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.heartbeat(ctx, task); err != nil {
+				log.Printf("worker: error heartbeating task %s: %v", task.ID, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer reproduces the subset of the real server's HTTP surface that
+// Client talks to. main.go's handlers can't be imported directly here -
+// package main isn't an importable package, and pulling its handler and
+// Store logic out into an importable package is a larger refactor than this
+// SDK warrants on its own - so this stands in for them, implementing the
+// same request/response shapes documented in main.go.
+//
+// Because of that, fakeServer's own concurrency behavior (see reserve) is
+// deliberately simple and is NOT a substitute for exercising the real
+// server's task-reservation and locking logic: correctness of concurrent
+// submit/reserve against the real handlers and Store implementations is
+// covered separately by main_test.go and store_test.go. Tests here verify
+// Client's request/response handling and retry/backoff behavior against a
+// server that speaks the same protocol, not the real server's guarantees.
+type fakeServer struct {
+	mu      sync.Mutex
+	tasks   map[string]*Task
+	results map[string]Result
+}
+
+func newFakeServer() *httptest.Server {
+	fs := &fakeServer{tasks: make(map[string]*Task), results: make(map[string]Result)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/task", fs.handleTask)
+	mux.HandleFunc("/task/nack", fs.handleNack)
+	mux.HandleFunc("/task/heartbeat", fs.handleHeartbeat)
+	mux.HandleFunc("/result", fs.handleResult)
+	return httptest.NewServer(mux)
+}
+
+func (fs *fakeServer) handleTask(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var task Task
+		if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		task.ID = fmt.Sprintf("task-%d", len(fs.tasks)+1)
+		task.Status = "new"
+		if task.VisibilityTimeout == 0 {
+			task.VisibilityTimeout = time.Minute
+		}
+		fs.mu.Lock()
+		fs.tasks[task.ID] = &task
+		fs.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(submitResponse{ID: task.ID})
+	case http.MethodGet:
+		topic := r.URL.Query().Get("topic")
+		deadline := time.Now().Add(50 * time.Millisecond)
+		if wait := r.URL.Query().Get("wait"); wait != "" {
+			if d, err := time.ParseDuration(wait); err == nil {
+				deadline = time.Now().Add(d)
+			}
+		}
+		for {
+			if task := fs.reserve(topic); task != nil {
+				json.NewEncoder(w).Encode(task)
+				return
+			}
+			if time.Now().After(deadline) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			select {
+			case <-time.After(2 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (fs *fakeServer) reserve(topic string) *Task {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, task := range fs.tasks {
+		if task.Topic == topic && task.Status == "new" {
+			task.Status = "pending"
+			task.LeaseID = fmt.Sprintf("lease-%s", task.ID)
+			return task
+		}
+	}
+	return nil
+}
+
+func (fs *fakeServer) handleNack(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	task, ok := fs.tasks[req.ID]
+	if !ok || task.LeaseID != req.LeaseID {
+		http.Error(w, "lease mismatch", http.StatusConflict)
+		return
+	}
+	task.Status = "new"
+	task.Attempts++
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fs *fakeServer) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	task, ok := fs.tasks[req.ID]
+	if !ok || task.LeaseID != req.LeaseID {
+		http.Error(w, "lease mismatch", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fs *fakeServer) handleResult(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var result Result
+		json.NewDecoder(r.Body).Decode(&result)
+
+		fs.mu.Lock()
+		task, ok := fs.tasks[result.ID]
+		if !ok || task.LeaseID != result.LeaseID {
+			fs.mu.Unlock()
+			http.Error(w, "lease mismatch", http.StatusConflict)
+			return
+		}
+		task.Status = "completed"
+		fs.results[result.ID] = result
+		fs.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		fs.mu.Lock()
+		result, ok := fs.results[id]
+		fs.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestClientSubmitAndWaitResult(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	client := &Client{BaseURL: server.URL, PollWait: 200 * time.Millisecond}
+
+	id, err := client.Submit(context.Background(), "greet", map[string]string{"name": "ada"})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if id == "" {
+		t.Fatal("Submit returned empty ID")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = client.Run(ctx, "greet", func(_ context.Context, task Task) (interface{}, error) {
+			return map[string]string{"greeting": "hi " + task.Input.(map[string]interface{})["name"].(string)}, nil
+		})
+	}()
+	defer cancel()
+
+	result, err := client.WaitResult(context.Background(), id)
+	if err != nil {
+		t.Fatalf("WaitResult: %v", err)
+	}
+	if result.ID != id {
+		t.Errorf("WaitResult returned result for %q, want %q", result.ID, id)
+	}
+}
+
+// TestClientRunNacksOnHandlerError verifies that a handler error causes the
+// task to be nacked and requeued rather than completed.
+func TestClientRunNacksOnHandlerError(t *testing.T) {
+	server := newFakeServer()
+	defer server.Close()
+	client := &Client{BaseURL: server.URL, PollWait: 50 * time.Millisecond}
+
+	id, err := client.Submit(context.Background(), "fails", map[string]string{"k": "v"})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	var calls int
+	var mu sync.Mutex
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_ = client.Run(ctx, "fails", func(_ context.Context, task Task) (interface{}, error) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		if n == 1 {
+			return nil, fmt.Errorf("boom")
+		}
+		cancel()
+		return map[string]string{"ok": "true"}, nil
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls < 2 {
+		t.Errorf("handler was called %d times, want at least 2 (one failure, one retry)", calls)
+	}
+	_ = id
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	cases := []struct {
+		name string
+		in   Backoff
+		want Backoff
+	}{
+		{"zero value", Backoff{}, Backoff{Initial: 100 * time.Millisecond, Max: 10 * time.Second, MaxAttempts: 5}},
+		{"custom values preserved", Backoff{Initial: time.Second, Max: time.Minute, MaxAttempts: 3}, Backoff{Initial: time.Second, Max: time.Minute, MaxAttempts: 3}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.in.withDefaults()
+			if got != c.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
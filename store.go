@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrLeaseMismatch is returned by CompleteTask, NackTask, and HeartbeatTask
+// when the caller's LeaseID doesn't match the task's current reservation,
+// e.g. because the lease expired and the task was handed to another worker.
+var ErrLeaseMismatch = errors.New("lease id does not match current reservation")
+
+// Store abstracts the persistence layer for tasks and results so the HTTP
+// handlers don't depend on any particular backend. All state was previously
+// held in package-level maps that were lost on restart; Store implementations
+// can instead back onto disk or a database so pending tasks survive a crash.
+type Store interface {
+	// SubmitTask persists a newly created task (already assigned an ID,
+	// Status "new", and a Timestamp). Zero-valued MaxAttempts and
+	// VisibilityTimeout are filled in with their package defaults.
+	SubmitTask(task Task) error
+
+	// ReserveTask finds the oldest "new" task for topic, assigns it a fresh
+	// LeaseID, marks it "pending" with a fresh timestamp, and returns it.
+	// The second return value is false if no eligible task was found.
+	ReserveTask(topic string) (Task, bool, error)
+
+	// MarkPending marks an existing task "pending" under leaseID, with the
+	// given timestamp. It's used when a task is handed directly to a
+	// long-poll or streaming subscriber at submit time, bypassing
+	// ReserveTask's scan.
+	MarkPending(id string, leaseID string, at time.Time) error
+
+	// CompleteTask marks the task referenced by result.ID "completed" and
+	// stores the result, provided result.LeaseID matches the task's current
+	// lease. It reports false if no such task exists, and ErrLeaseMismatch
+	// if the lease doesn't match.
+	CompleteTask(result Result) (bool, error)
+
+	// NackTask releases a task early so it can be retried sooner than its
+	// visibility timeout would otherwise allow. It increments Attempts and,
+	// if that meets or exceeds MaxAttempts, moves the task to its
+	// dead-letter topic instead of requeuing it. It reports false if no such
+	// task exists, and ErrLeaseMismatch if leaseID doesn't match.
+	NackTask(id string, leaseID string) (bool, error)
+
+	// HeartbeatTask extends a task's visibility deadline by refreshing its
+	// timestamp to at, without changing its status or Attempts. It reports
+	// false if no such task exists, and ErrLeaseMismatch if leaseID doesn't
+	// match.
+	HeartbeatTask(id string, leaseID string, at time.Time) (bool, error)
+
+	// SweepExpiredLeases finds "pending" tasks whose VisibilityTimeout has
+	// elapsed since their Timestamp and reclaims them: each either goes back
+	// to "new" with Attempts incremented, or - if that meets or exceeds
+	// MaxAttempts - moves to its dead-letter topic. It returns how many
+	// tasks were reclaimed and how many were dead-lettered.
+	SweepExpiredLeases(now time.Time) (reclaimed int, deadLettered int, err error)
+
+	// GetTask looks up a task by ID.
+	GetTask(id string) (Task, bool, error)
+
+	// GetResult looks up a result by task ID.
+	GetResult(id string) (Result, bool, error)
+
+	// ListTasks returns every known task, in no particular order.
+	ListTasks() ([]Task, error)
+
+	// ListResults returns every known result, in no particular order.
+	ListResults() ([]Result, error)
+}
+
+// newStoreFromEnv picks a Store implementation based on the STORE_BACKEND
+// environment variable ("memory", the default; "bolt"; or "sql"), reading any
+// backend-specific configuration from its own environment variables.
+func newStoreFromEnv() (Store, error) {
+	switch backend := os.Getenv("STORE_BACKEND"); backend {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = "workpluck.db"
+		}
+		return newBoltStore(path)
+	case "sql":
+		driver := os.Getenv("SQL_DRIVER")
+		if driver == "" {
+			driver = "sqlite"
+		}
+		dsn := os.Getenv("SQL_DSN")
+		if dsn == "" {
+			dsn = "workpluck.sqlite"
+		}
+		return newSQLStore(driver, dsn)
+	default:
+		return nil, fmt.Errorf("unknown STORE_BACKEND %q", backend)
+	}
+}
+
+// dlqTopic returns the dead-letter topic a task with the given source topic
+// moves to once it exhausts its MaxAttempts. A topic already on its
+// dead-letter topic is left as-is, so a task that exhausts MaxAttempts again
+// after being dead-lettered stays on the same terminal topic instead of
+// accumulating repeated ".dlq" suffixes.
+func dlqTopic(topic string) string {
+	if strings.HasSuffix(topic, dlqSuffix) {
+		return topic
+	}
+	return topic + dlqSuffix
+}
+
+// applyTaskDefaults fills in zero-valued retry/visibility fields on a
+// newly-submitted task with the package defaults.
+func applyTaskDefaults(task Task) Task {
+	if task.MaxAttempts <= 0 {
+		task.MaxAttempts = defaultMaxAttempts
+	}
+	if task.VisibilityTimeout <= 0 {
+		task.VisibilityTimeout = defaultVisibilityTimeout
+	}
+	return task
+}
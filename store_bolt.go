@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	tasksBucket   = []byte("tasks")
+	resultsBucket = []byte("results")
+)
+
+// boltStore persists tasks and results to a single BoltDB file, so pending
+// tasks survive a server restart instead of being lost like memoryStore's.
+// BoltDB serializes all writes through its own transaction lock, so no extra
+// mutex is needed here.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(tasksBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(resultsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) SubmitTask(task Task) error {
+	task = applyTaskDefaults(task)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(tasksBucket).Put([]byte(task.ID), data)
+	})
+}
+
+// ReserveTask picks the oldest "new" task for topic (by Timestamp) so
+// workers are served in submission order instead of bucket iteration order.
+func (s *boltStore) ReserveTask(topic string) (Task, bool, error) {
+	var reserved Task
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		var oldestKey []byte
+		var oldest Task
+		err := bucket.ForEach(func(k, v []byte) error {
+			var task Task
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			if task.Topic != topic || task.Status != "new" {
+				return nil
+			}
+			if oldestKey == nil || task.Timestamp.Before(oldest.Timestamp) {
+				oldestKey = append([]byte(nil), k...)
+				oldest = task
+			}
+			return nil
+		})
+		if err != nil || oldestKey == nil {
+			return err
+		}
+
+		oldest.Status = "pending"
+		oldest.Timestamp = time.Now()
+		oldest.LeaseID = uuid.New().String()
+		data, err := json.Marshal(oldest)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(oldestKey, data); err != nil {
+			return err
+		}
+		reserved = oldest
+		found = true
+		return nil
+	})
+	return reserved, found, err
+}
+
+func (s *boltStore) MarkPending(id string, leaseID string, at time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			return err
+		}
+		task.Status = "pending"
+		task.Timestamp = at
+		task.LeaseID = leaseID
+		updated, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), updated)
+	})
+}
+
+func (s *boltStore) CompleteTask(result Result) (bool, error) {
+	var existed bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		tasks := tx.Bucket(tasksBucket)
+		data := tasks.Get([]byte(result.ID))
+		if data == nil {
+			return nil
+		}
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			return err
+		}
+		if task.LeaseID != result.LeaseID {
+			return ErrLeaseMismatch
+		}
+		task.Status = "completed"
+		updated, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if err := tasks.Put([]byte(result.ID), updated); err != nil {
+			return err
+		}
+		resultData, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(resultsBucket).Put([]byte(result.ID), resultData); err != nil {
+			return err
+		}
+		existed = true
+		return nil
+	})
+	if err == ErrLeaseMismatch {
+		return false, ErrLeaseMismatch
+	}
+	return existed, err
+}
+
+func (s *boltStore) NackTask(id string, leaseID string) (bool, error) {
+	var existed bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			return err
+		}
+		if task.LeaseID != leaseID {
+			return ErrLeaseMismatch
+		}
+		updated, err := json.Marshal(reclaimOrDeadLetter(task, time.Now()))
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(id), updated); err != nil {
+			return err
+		}
+		existed = true
+		return nil
+	})
+	if err == ErrLeaseMismatch {
+		return false, ErrLeaseMismatch
+	}
+	return existed, err
+}
+
+func (s *boltStore) HeartbeatTask(id string, leaseID string, at time.Time) (bool, error) {
+	var existed bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		data := bucket.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		var task Task
+		if err := json.Unmarshal(data, &task); err != nil {
+			return err
+		}
+		if task.LeaseID != leaseID {
+			return ErrLeaseMismatch
+		}
+		task.Timestamp = at
+		updated, err := json.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(id), updated); err != nil {
+			return err
+		}
+		existed = true
+		return nil
+	})
+	if err == ErrLeaseMismatch {
+		return false, ErrLeaseMismatch
+	}
+	return existed, err
+}
+
+func (s *boltStore) SweepExpiredLeases(now time.Time) (int, int, error) {
+	var reclaimed, deadLettered int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tasksBucket)
+		return bucket.ForEach(func(k, v []byte) error {
+			var task Task
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			if task.Status != "pending" || now.Sub(task.Timestamp) <= task.VisibilityTimeout {
+				return nil
+			}
+			originalTopic := task.Topic
+			updated := reclaimOrDeadLetter(task, now)
+			data, err := json.Marshal(updated)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(k, data); err != nil {
+				return err
+			}
+			if updated.Topic == dlqTopic(originalTopic) {
+				deadLettered++
+			} else {
+				reclaimed++
+			}
+			return nil
+		})
+	})
+	return reclaimed, deadLettered, err
+}
+
+func (s *boltStore) GetTask(id string) (Task, bool, error) {
+	var task Task
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(tasksBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &task)
+	})
+	return task, found, err
+}
+
+func (s *boltStore) GetResult(id string) (Result, bool, error) {
+	var result Result
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(resultsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &result)
+	})
+	return result, found, err
+}
+
+func (s *boltStore) ListTasks() ([]Task, error) {
+	var tasks []Task
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+			var task Task
+			if err := json.Unmarshal(v, &task); err != nil {
+				return err
+			}
+			tasks = append(tasks, task)
+			return nil
+		})
+	})
+	return tasks, err
+}
+
+func (s *boltStore) ListResults() ([]Result, error) {
+	var results []Result
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(resultsBucket).ForEach(func(k, v []byte) error {
+			var result Result
+			if err := json.Unmarshal(v, &result); err != nil {
+				return err
+			}
+			results = append(results, result)
+			return nil
+		})
+	})
+	return results, err
+}
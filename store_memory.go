@@ -0,0 +1,191 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryStore is the original in-memory Store backend: two maps guarded by a
+// mutex. It's the default backend and matches workpluck's behavior before
+// Store existed, including losing all state on restart.
+type memoryStore struct {
+	mu      sync.Mutex
+	tasks   map[string]Task
+	results map[string]Result
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tasks:   make(map[string]Task),
+		results: make(map[string]Result),
+	}
+}
+
+func (s *memoryStore) SubmitTask(task Task) error {
+	task = applyTaskDefaults(task)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[task.ID] = task
+	return nil
+}
+
+// ReserveTask picks the oldest "new" task for topic (by Timestamp) so
+// workers are served in submission order instead of arbitrary map iteration
+// order.
+func (s *memoryStore) ReserveTask(topic string) (Task, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldestID string
+	var oldest Task
+	found := false
+	for id, task := range s.tasks {
+		if task.Topic != topic || task.Status != "new" {
+			continue
+		}
+		if !found || task.Timestamp.Before(oldest.Timestamp) {
+			oldestID = id
+			oldest = task
+			found = true
+		}
+	}
+	if !found {
+		return Task{}, false, nil
+	}
+
+	oldest.Status = "pending"
+	oldest.Timestamp = time.Now()
+	oldest.LeaseID = uuid.New().String()
+	s.tasks[oldestID] = oldest
+	return oldest, true, nil
+}
+
+func (s *memoryStore) MarkPending(id string, leaseID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok {
+		return nil
+	}
+	task.Status = "pending"
+	task.Timestamp = at
+	task.LeaseID = leaseID
+	s.tasks[id] = task
+	return nil
+}
+
+func (s *memoryStore) CompleteTask(result Result) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[result.ID]
+	if !ok {
+		return false, nil
+	}
+	if task.LeaseID != result.LeaseID {
+		return false, ErrLeaseMismatch
+	}
+	task.Status = "completed"
+	s.tasks[result.ID] = task
+	s.results[result.ID] = result
+	return true, nil
+}
+
+func (s *memoryStore) NackTask(id string, leaseID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok {
+		return false, nil
+	}
+	if task.LeaseID != leaseID {
+		return false, ErrLeaseMismatch
+	}
+	s.tasks[id] = reclaimOrDeadLetter(task, time.Now())
+	return true, nil
+}
+
+func (s *memoryStore) HeartbeatTask(id string, leaseID string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	if !ok {
+		return false, nil
+	}
+	if task.LeaseID != leaseID {
+		return false, ErrLeaseMismatch
+	}
+	task.Timestamp = at
+	s.tasks[id] = task
+	return true, nil
+}
+
+func (s *memoryStore) SweepExpiredLeases(now time.Time) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reclaimed, deadLettered int
+	for id, task := range s.tasks {
+		if task.Status != "pending" || now.Sub(task.Timestamp) <= task.VisibilityTimeout {
+			continue
+		}
+		updated := reclaimOrDeadLetter(task, now)
+		s.tasks[id] = updated
+		if updated.Topic == dlqTopic(task.Topic) {
+			deadLettered++
+		} else {
+			reclaimed++
+		}
+	}
+	return reclaimed, deadLettered, nil
+}
+
+// reclaimOrDeadLetter increments a lost task's Attempts and either requeues
+// it as "new" on its original topic, or - once MaxAttempts is exhausted -
+// moves it to its dead-letter topic, still as "new" so a dlq consumer can
+// retrieve it the same way any other task is retrieved.
+func reclaimOrDeadLetter(task Task, now time.Time) Task {
+	task.Attempts++
+	task.LeaseID = ""
+	task.Status = "new"
+	task.Timestamp = now
+	if task.Attempts >= task.MaxAttempts {
+		task.Topic = dlqTopic(task.Topic)
+	}
+	return task
+}
+
+func (s *memoryStore) GetTask(id string) (Task, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[id]
+	return task, ok, nil
+}
+
+func (s *memoryStore) GetResult(id string) (Result, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[id]
+	return result, ok, nil
+}
+
+func (s *memoryStore) ListTasks() ([]Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tasks := make([]Task, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func (s *memoryStore) ListResults() ([]Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]Result, 0, len(s.results))
+	for _, result := range s.results {
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// sqlStore persists tasks and results in a SQL database via database/sql, so
+// it can run against either SQLite (single-file, for local/single-instance
+// deployments) or Postgres (for sharing state across multiple server
+// instances). input/output payloads are stored as JSON text since Task.Input
+// and Result.Output are arbitrary interface{} values.
+type sqlStore struct {
+	db         *sql.DB
+	driverName string
+}
+
+func newSQLStore(driverName, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driverName != "postgres" {
+		// SQLite allows only one writer at a time; with more than one
+		// connection in the pool, concurrent transactions fail with
+		// SQLITE_BUSY instead of queuing. Forcing a single connection makes
+		// database/sql serialize them instead.
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqlStore{db: db, driverName: driverName}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// placeholder returns the positional parameter marker for this store's
+// driver: Postgres uses $1, $2, ...; everything else (SQLite) uses ?.
+func (s *sqlStore) placeholder(n int) string {
+	if s.driverName == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func (s *sqlStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS tasks (
+		id TEXT PRIMARY KEY,
+		topic TEXT NOT NULL,
+		input TEXT NOT NULL,
+		status TEXT NOT NULL,
+		timestamp TEXT NOT NULL,
+		submit_time TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 0,
+		visibility_timeout_ns INTEGER NOT NULL DEFAULT 0,
+		lease_id TEXT NOT NULL DEFAULT '',
+		metadata TEXT NOT NULL DEFAULT '{}'
+	)`)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_tasks_topic_status ON tasks (topic, status)`); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS results (
+		id TEXT PRIMARY KEY,
+		output TEXT NOT NULL
+	)`)
+	return err
+}
+
+func (s *sqlStore) SubmitTask(task Task) error {
+	task = applyTaskDefaults(task)
+	input, err := json.Marshal(task.Input)
+	if err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(task.Metadata)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`INSERT INTO tasks (id, topic, input, status, timestamp, submit_time, attempts, max_attempts, visibility_timeout_ns, lease_id, metadata)
+		VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s)`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5),
+		s.placeholder(6), s.placeholder(7), s.placeholder(8), s.placeholder(9), s.placeholder(10), s.placeholder(11))
+	_, err = s.db.Exec(query, task.ID, task.Topic, string(input), task.Status, task.Timestamp.Format(time.RFC3339Nano),
+		task.SubmitTime.Format(time.RFC3339Nano), task.Attempts, task.MaxAttempts, int64(task.VisibilityTimeout), task.LeaseID, string(metadata))
+	return err
+}
+
+// ReserveTask picks the oldest "new" task for topic (ORDER BY timestamp) so
+// workers are served in submission order, using the (topic, status) index
+// instead of an O(n) scan.
+// ReserveTask picks the oldest "new" task for topic and marks it "pending" in
+// a single UPDATE ... WHERE id = (SELECT ...) statement, rather than a
+// separate SELECT followed by an UPDATE. Two reservations running the
+// earlier, split form could both SELECT the same row before either UPDATE
+// committed - under Postgres's default READ COMMITTED isolation in
+// particular, which has no implicit locking on plain SELECTs - handing the
+// same task to two workers. On Postgres, the subquery also takes FOR UPDATE
+// SKIP LOCKED, so a reservation already in flight on another row is skipped
+// over instead of contending for it. SQLite has no such clause: a write
+// statement locks the whole database for its duration regardless, so the
+// single-statement form alone is enough there.
+func (s *sqlStore) ReserveTask(topic string) (Task, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Task{}, false, err
+	}
+	defer tx.Rollback()
+
+	// Placeholders are numbered in the order they appear in the query text
+	// (topic, then status/timestamp/lease_id), not the order described above:
+	// SQLite binds "?" placeholders positionally by occurrence, so the
+	// argument order passed to QueryRow below must match the text order
+	// regardless of driver.
+	selectQuery := fmt.Sprintf("SELECT id FROM tasks WHERE topic = %s AND status = 'new' ORDER BY timestamp ASC LIMIT 1",
+		s.placeholder(1))
+	if s.driverName == "postgres" {
+		selectQuery += " FOR UPDATE SKIP LOCKED"
+	}
+	query := fmt.Sprintf(
+		`WITH selected AS (%s) UPDATE tasks SET status = %s, timestamp = %s, lease_id = %s WHERE id IN (SELECT id FROM selected) RETURNING %s`,
+		selectQuery, s.placeholder(2), s.placeholder(3), s.placeholder(4), taskColumns)
+
+	leaseID := uuid.New().String()
+	now := time.Now()
+	task, err := scanTask(tx.QueryRow(query, topic, "pending", now.Format(time.RFC3339Nano), leaseID))
+	if err == sql.ErrNoRows {
+		return Task{}, false, nil
+	}
+	if err != nil {
+		return Task{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Task{}, false, err
+	}
+	return task, true, nil
+}
+
+func (s *sqlStore) MarkPending(id string, leaseID string, at time.Time) error {
+	query := fmt.Sprintf("UPDATE tasks SET status = %s, timestamp = %s, lease_id = %s WHERE id = %s",
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4))
+	_, err := s.db.Exec(query, "pending", at.Format(time.RFC3339Nano), leaseID, id)
+	return err
+}
+
+func (s *sqlStore) CompleteTask(result Result) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT %s FROM tasks WHERE id = %s", taskColumns, s.placeholder(1))
+	task, err := scanTask(tx.QueryRow(query, result.ID))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if task.LeaseID != result.LeaseID {
+		return false, ErrLeaseMismatch
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE tasks SET status = 'completed' WHERE id = %s", s.placeholder(1)), result.ID); err != nil {
+		return false, err
+	}
+
+	output, err := json.Marshal(result.Output)
+	if err != nil {
+		return false, err
+	}
+	upsert := fmt.Sprintf("INSERT INTO results (id, output) VALUES (%s, %s)", s.placeholder(1), s.placeholder(2))
+	if _, err := tx.Exec(upsert, result.ID, string(output)); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqlStore) NackTask(id string, leaseID string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT %s FROM tasks WHERE id = %s", taskColumns, s.placeholder(1))
+	task, err := scanTask(tx.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if task.LeaseID != leaseID {
+		return false, ErrLeaseMismatch
+	}
+
+	if err := s.saveTask(tx, reclaimOrDeadLetter(task, time.Now())); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqlStore) HeartbeatTask(id string, leaseID string, at time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("SELECT %s FROM tasks WHERE id = %s", taskColumns, s.placeholder(1))
+	task, err := scanTask(tx.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if task.LeaseID != leaseID {
+		return false, ErrLeaseMismatch
+	}
+
+	updateQuery := fmt.Sprintf("UPDATE tasks SET timestamp = %s WHERE id = %s", s.placeholder(1), s.placeholder(2))
+	if _, err := tx.Exec(updateQuery, at.Format(time.RFC3339Nano), id); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *sqlStore) SweepExpiredLeases(now time.Time) (int, int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM tasks WHERE status = 'pending'", taskColumns))
+	if err != nil {
+		return 0, 0, err
+	}
+	var expired []Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		if now.Sub(task.Timestamp) > task.VisibilityTimeout {
+			expired = append(expired, task)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	var reclaimed, deadLettered int
+	for _, task := range expired {
+		updated := reclaimOrDeadLetter(task, now)
+		if err := s.saveTask(tx, updated); err != nil {
+			return 0, 0, err
+		}
+		if updated.Topic == dlqTopic(task.Topic) {
+			deadLettered++
+		} else {
+			reclaimed++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return reclaimed, deadLettered, nil
+}
+
+// saveTask writes every mutable column of task back to its row. Used by the
+// code paths (nack, sweep) that rewrite several fields at once.
+func (s *sqlStore) saveTask(tx *sql.Tx, task Task) error {
+	query := fmt.Sprintf(`UPDATE tasks SET topic = %s, status = %s, timestamp = %s, attempts = %s, lease_id = %s WHERE id = %s`,
+		s.placeholder(1), s.placeholder(2), s.placeholder(3), s.placeholder(4), s.placeholder(5), s.placeholder(6))
+	_, err := tx.Exec(query, task.Topic, task.Status, task.Timestamp.Format(time.RFC3339Nano), task.Attempts, task.LeaseID, task.ID)
+	return err
+}
+
+func (s *sqlStore) GetTask(id string) (Task, bool, error) {
+	query := fmt.Sprintf("SELECT %s FROM tasks WHERE id = %s", taskColumns, s.placeholder(1))
+	task, err := scanTask(s.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return Task{}, false, nil
+	}
+	if err != nil {
+		return Task{}, false, err
+	}
+	return task, true, nil
+}
+
+func (s *sqlStore) GetResult(id string) (Result, bool, error) {
+	query := fmt.Sprintf("SELECT id, output FROM results WHERE id = %s", s.placeholder(1))
+	var result Result
+	var output string
+	err := s.db.QueryRow(query, id).Scan(&result.ID, &output)
+	if err == sql.ErrNoRows {
+		return Result{}, false, nil
+	}
+	if err != nil {
+		return Result{}, false, err
+	}
+	if err := json.Unmarshal([]byte(output), &result.Output); err != nil {
+		return Result{}, false, err
+	}
+	return result, true, nil
+}
+
+func (s *sqlStore) ListTasks() ([]Task, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT %s FROM tasks", taskColumns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+func (s *sqlStore) ListResults() ([]Result, error) {
+	rows, err := s.db.Query("SELECT id, output FROM results")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []Result
+	for rows.Next() {
+		var result Result
+		var output string
+		if err := rows.Scan(&result.ID, &output); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(output), &result.Output); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// taskColumns lists the tasks columns in the order scanTask expects them.
+const taskColumns = "id, topic, input, status, timestamp, submit_time, attempts, max_attempts, visibility_timeout_ns, lease_id, metadata"
+
+// rowScanner covers both *sql.Row and *sql.Rows so scanTask can be reused
+// regardless of whether the caller is reading one task or iterating many.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTask(row rowScanner) (Task, error) {
+	var task Task
+	var input, timestamp, submitTime, metadata string
+	var visibilityNs int64
+	if err := row.Scan(&task.ID, &task.Topic, &input, &task.Status, &timestamp, &submitTime,
+		&task.Attempts, &task.MaxAttempts, &visibilityNs, &task.LeaseID, &metadata); err != nil {
+		return Task{}, err
+	}
+	if err := json.Unmarshal([]byte(input), &task.Input); err != nil {
+		return Task{}, err
+	}
+	if err := json.Unmarshal([]byte(metadata), &task.Metadata); err != nil {
+		return Task{}, err
+	}
+	ts, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return Task{}, err
+	}
+	task.Timestamp = ts
+	st, err := time.Parse(time.RFC3339Nano, submitTime)
+	if err != nil {
+		return Task{}, err
+	}
+	task.SubmitTime = st
+	task.VisibilityTimeout = time.Duration(visibilityNs)
+	return task, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns one instance of every Store implementation so the
+// shared behavior below runs against all of them.
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	boltPath := filepath.Join(t.TempDir(), "test.db")
+	boltStore, err := newBoltStore(boltPath)
+	if err != nil {
+		t.Fatalf("newBoltStore: %v", err)
+	}
+	t.Cleanup(func() { boltStore.db.Close() })
+
+	sqlPath := filepath.Join(t.TempDir(), "test.sqlite")
+	sqlStore, err := newSQLStore("sqlite", sqlPath)
+	if err != nil {
+		t.Fatalf("newSQLStore: %v", err)
+	}
+	t.Cleanup(func() { sqlStore.db.Close() })
+
+	return map[string]Store{
+		"memory": newMemoryStore(),
+		"bolt":   boltStore,
+		"sql":    sqlStore,
+	}
+}
+
+func TestStoreSubmitAndReserveTask(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-1", Topic: "topic-a", Input: map[string]interface{}{"k": "v"}, Status: "new", Timestamp: time.Now()}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+
+			reserved, found, err := s.ReserveTask("topic-a")
+			if err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+			if !found || reserved.ID != task.ID || reserved.Status != "pending" {
+				t.Fatalf("ReserveTask returned %+v, found=%v", reserved, found)
+			}
+
+			if _, found, err := s.ReserveTask("topic-a"); err != nil || found {
+				t.Fatalf("expected no further eligible task, got found=%v err=%v", found, err)
+			}
+		})
+	}
+}
+
+func TestStoreCompleteAndGetResult(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-2", Topic: "topic-b", Input: "in", Status: "new", Timestamp: time.Now()}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+
+			result := Result{ID: task.ID, Output: "out"}
+			ok, err := s.CompleteTask(result)
+			if err != nil || !ok {
+				t.Fatalf("CompleteTask: ok=%v err=%v", ok, err)
+			}
+
+			gotTask, found, err := s.GetTask(task.ID)
+			if err != nil || !found || gotTask.Status != "completed" {
+				t.Fatalf("GetTask after completion: %+v found=%v err=%v", gotTask, found, err)
+			}
+
+			gotResult, found, err := s.GetResult(task.ID)
+			if err != nil || !found || gotResult.Output != "out" {
+				t.Fatalf("GetResult: %+v found=%v err=%v", gotResult, found, err)
+			}
+		})
+	}
+}
+
+func TestStoreCompleteTaskMissing(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ok, err := s.CompleteTask(Result{ID: "does-not-exist", Output: "out"})
+			if err != nil || ok {
+				t.Fatalf("expected CompleteTask to report missing task, got ok=%v err=%v", ok, err)
+			}
+		})
+	}
+}
+
+func TestStoreCompleteTaskLeaseMismatch(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-lease", Topic: "topic-c", Status: "new", Timestamp: time.Now()}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			if _, _, err := s.ReserveTask("topic-c"); err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+
+			ok, err := s.CompleteTask(Result{ID: task.ID, Output: "out", LeaseID: "wrong-lease"})
+			if ok || err != ErrLeaseMismatch {
+				t.Fatalf("expected ErrLeaseMismatch, got ok=%v err=%v", ok, err)
+			}
+		})
+	}
+}
+
+func TestStoreNackTaskRequeues(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-nack", Topic: "topic-d", Status: "new", Timestamp: time.Now(), MaxAttempts: 5}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			reserved, _, err := s.ReserveTask("topic-d")
+			if err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+
+			ok, err := s.NackTask(task.ID, reserved.LeaseID)
+			if err != nil || !ok {
+				t.Fatalf("NackTask: ok=%v err=%v", ok, err)
+			}
+
+			got, found, err := s.GetTask(task.ID)
+			if err != nil || !found || got.Status != "new" || got.Attempts != 1 {
+				t.Fatalf("GetTask after nack: %+v found=%v err=%v", got, found, err)
+			}
+		})
+	}
+}
+
+func TestStoreNackTaskDeadLettersAfterMaxAttempts(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-dlq", Topic: "topic-e", Status: "new", Timestamp: time.Now(), MaxAttempts: 1}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			reserved, _, err := s.ReserveTask("topic-e")
+			if err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+
+			if ok, err := s.NackTask(task.ID, reserved.LeaseID); err != nil || !ok {
+				t.Fatalf("NackTask: ok=%v err=%v", ok, err)
+			}
+
+			got, found, err := s.GetTask(task.ID)
+			if err != nil || !found || got.Topic != "topic-e.dlq" || got.Status != "new" {
+				t.Fatalf("expected task dead-lettered to topic-e.dlq, got %+v found=%v err=%v", got, found, err)
+			}
+		})
+	}
+}
+
+// TestStoreNackTaskDeadLetterIsStable is a regression test for dlqTopic
+// re-suffixing: a task already on its dead-letter topic that exhausts
+// MaxAttempts again must stay on that same topic instead of moving to
+// "<topic>.dlq.dlq".
+func TestStoreNackTaskDeadLetterIsStable(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-dlq-stable", Topic: "topic-e.dlq", Status: "new", Timestamp: time.Now(), MaxAttempts: 1}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			reserved, _, err := s.ReserveTask("topic-e.dlq")
+			if err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+
+			if ok, err := s.NackTask(task.ID, reserved.LeaseID); err != nil || !ok {
+				t.Fatalf("NackTask: ok=%v err=%v", ok, err)
+			}
+
+			got, found, err := s.GetTask(task.ID)
+			if err != nil || !found || got.Topic != "topic-e.dlq" || got.Status != "new" {
+				t.Fatalf("expected task to stay on topic-e.dlq, got %+v found=%v err=%v", got, found, err)
+			}
+		})
+	}
+}
+
+func TestStoreHeartbeatTaskExtendsTimestamp(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			task := Task{ID: "task-hb", Topic: "topic-f", Status: "new", Timestamp: time.Now()}
+			if err := s.SubmitTask(task); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			reserved, _, err := s.ReserveTask("topic-f")
+			if err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+
+			later := time.Now().Add(time.Hour)
+			if ok, err := s.HeartbeatTask(task.ID, reserved.LeaseID, later); err != nil || !ok {
+				t.Fatalf("HeartbeatTask: ok=%v err=%v", ok, err)
+			}
+
+			got, found, err := s.GetTask(task.ID)
+			if err != nil || !found || !got.Timestamp.Equal(later) {
+				t.Fatalf("expected timestamp extended to %v, got %+v found=%v err=%v", later, got, found, err)
+			}
+
+			if ok, err := s.HeartbeatTask(task.ID, "wrong-lease", later); ok || err != ErrLeaseMismatch {
+				t.Fatalf("expected ErrLeaseMismatch, got ok=%v err=%v", ok, err)
+			}
+		})
+	}
+}
+
+func TestStoreSweepExpiredLeases(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			reclaimable := Task{ID: "task-sweep-reclaim", Topic: "topic-g", Status: "new", Timestamp: time.Now(), MaxAttempts: 5, VisibilityTimeout: time.Minute}
+			deadLettered := Task{ID: "task-sweep-dlq", Topic: "topic-h", Status: "new", Timestamp: time.Now(), MaxAttempts: 1, VisibilityTimeout: time.Minute}
+			if err := s.SubmitTask(reclaimable); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			if err := s.SubmitTask(deadLettered); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+			if _, _, err := s.ReserveTask("topic-g"); err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+			if _, _, err := s.ReserveTask("topic-h"); err != nil {
+				t.Fatalf("ReserveTask: %v", err)
+			}
+
+			reclaimed, dead, err := s.SweepExpiredLeases(time.Now().Add(2 * time.Minute))
+			if err != nil || reclaimed != 1 || dead != 1 {
+				t.Fatalf("SweepExpiredLeases: reclaimed=%d dead=%d err=%v", reclaimed, dead, err)
+			}
+
+			got, found, err := s.GetTask("task-sweep-reclaim")
+			if err != nil || !found || got.Status != "new" || got.Topic != "topic-g" {
+				t.Fatalf("expected reclaimed task back on topic-g, got %+v found=%v err=%v", got, found, err)
+			}
+
+			got, found, err = s.GetTask("task-sweep-dlq")
+			if err != nil || !found || got.Status != "new" || got.Topic != "topic-h.dlq" {
+				t.Fatalf("expected dead-lettered task on topic-h.dlq, got %+v found=%v err=%v", got, found, err)
+			}
+		})
+	}
+}
+
+// TestStoreReserveTaskConcurrentNoDoubleDelivery is a regression test for a
+// race in sqlStore.ReserveTask, which used to SELECT the oldest "new" task
+// and UPDATE it as two separate statements: two concurrent reservations
+// could both SELECT the same row before either UPDATE committed, handing the
+// same task to two callers with two different LeaseIDs.
+func TestStoreReserveTaskConcurrentNoDoubleDelivery(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.SubmitTask(Task{ID: "task-concurrent", Topic: "topic-concurrent", Status: "new", Timestamp: time.Now()}); err != nil {
+				t.Fatalf("SubmitTask: %v", err)
+			}
+
+			const attempts = 20
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var found int
+			var leases []string
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					task, ok, err := s.ReserveTask("topic-concurrent")
+					if err != nil {
+						t.Errorf("ReserveTask: %v", err)
+						return
+					}
+					if ok {
+						mu.Lock()
+						found++
+						leases = append(leases, task.LeaseID)
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if found != 1 {
+				t.Fatalf("task was reserved %d times concurrently, want exactly 1; leases: %v", found, leases)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// TopicSchema is the registered contract for a topic: JSON Schemas that
+// Input (on submit) and Output (on result) must validate against. Either
+// schema may be left empty to skip validation for that side.
+type TopicSchema struct {
+	Topic        string          `json:"topic" msgpack:"topic"`
+	InputSchema  json.RawMessage `json:"input_schema,omitempty" msgpack:"input_schema,omitempty"`
+	OutputSchema json.RawMessage `json:"output_schema,omitempty" msgpack:"output_schema,omitempty"`
+}
+
+// topicSchemas holds registered schemas, keyed by topic name. Access is
+// guarded by topicSchemasMutex, mirroring taskWaiters/waitersMutex.
+var topicSchemas = make(map[string]TopicSchema)
+var topicSchemasMutex = &sync.Mutex{}
+
+// strictTopics, when true, causes handleTaskSubmit to reject submissions to
+// any topic without a registered schema. It's read from the STRICT_TOPICS
+// env var in main().
+var strictTopics bool
+
+// registerTopicSchema compiles schema's InputSchema and OutputSchema (to
+// reject malformed schemas up front) and stores it, replacing any existing
+// registration for the same topic.
+func registerTopicSchema(schema TopicSchema) error {
+	if _, err := compileSchema(schema.InputSchema); err != nil {
+		return fmt.Errorf("invalid input_schema: %w", err)
+	}
+	if _, err := compileSchema(schema.OutputSchema); err != nil {
+		return fmt.Errorf("invalid output_schema: %w", err)
+	}
+
+	topicSchemasMutex.Lock()
+	defer topicSchemasMutex.Unlock()
+	topicSchemas[schema.Topic] = schema
+	return nil
+}
+
+// lookupTopicSchema returns the schema registered for topic, if any.
+func lookupTopicSchema(topic string) (TopicSchema, bool) {
+	topicSchemasMutex.Lock()
+	defer topicSchemasMutex.Unlock()
+	schema, ok := topicSchemas[topic]
+	return schema, ok
+}
+
+// compileSchema parses raw as a JSON Schema. A nil or empty raw is valid and
+// yields a nil *gojsonschema.Schema, meaning "no validation".
+func compileSchema(raw json.RawMessage) (*gojsonschema.Schema, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewBytesLoader(raw))
+}
+
+// validateAgainstSchema validates value against raw, returning the JSON
+// Schema validation errors (if any). A nil or empty raw always passes.
+func validateAgainstSchema(raw json.RawMessage, value interface{}) ([]string, error) {
+	schema, err := compileSchema(raw)
+	if err != nil || schema == nil {
+		return nil, err
+	}
+
+	result, err := schema.Validate(gojsonschema.NewGoLoader(value))
+	if err != nil {
+		return nil, err
+	}
+	if result.Valid() {
+		return nil, nil
+	}
+
+	errs := make([]string, 0, len(result.Errors()))
+	for _, e := range result.Errors() {
+		errs = append(errs, e.String())
+	}
+	return errs, nil
+}
+
+// writeValidationErrors responds 422 with a structured list of validation
+// error messages.
+func writeValidationErrors(w http.ResponseWriter, errs []string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Errors []string `json:"errors"`
+	}{Errors: errs})
+}
+
+// handleTopics handles POST /topics, registering or replacing a topic's
+// input/output schemas.
+func handleTopics(w http.ResponseWriter, r *http.Request) {
+	log.Println("handleTopics called")
+	_, span := tracer.Start(r.Context(), "handleTopics")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		log.Println("Invalid method in handleTopics")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		span.AddEvent("Invalid method")
+		return
+	}
+
+	var schema TopicSchema
+	if err := decodeBody(r, &schema); err != nil {
+		log.Printf("Error decoding topic schema: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		span.RecordError(err)
+		return
+	}
+	if schema.Topic == "" {
+		log.Println("Topic is required in handleTopics")
+		http.Error(w, "Topic is required", http.StatusBadRequest)
+		span.AddEvent("Missing topic")
+		return
+	}
+
+	if err := registerTopicSchema(schema); err != nil {
+		log.Printf("Error registering topic schema: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		span.RecordError(err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	log.Printf("Topic schema registered: %s", schema.Topic)
+}
+
+// handleTopicSchema handles GET /topics/{name}/schema, returning the
+// registered schema for name so worker SDKs can fetch it and code-generate
+// types.
+func handleTopicSchema(w http.ResponseWriter, r *http.Request) {
+	log.Println("handleTopicSchema called")
+	_, span := tracer.Start(r.Context(), "handleTopicSchema")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		log.Println("Invalid method in handleTopicSchema")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		span.AddEvent("Invalid method")
+		return
+	}
+
+	topic := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/topics/"), "/schema")
+	if topic == "" || !strings.HasSuffix(r.URL.Path, "/schema") {
+		log.Println("Not found in handleTopicSchema")
+		http.NotFound(w, r)
+		span.AddEvent("Not found")
+		return
+	}
+
+	schema, ok := lookupTopicSchema(topic)
+	if !ok {
+		log.Printf("Topic schema not found: %s", topic)
+		http.NotFound(w, r)
+		span.AddEvent("Schema not found")
+		return
+	}
+
+	if err := encodeResponse(w, r, schema); err != nil {
+		log.Printf("Error encoding topic schema: %v", err)
+		span.RecordError(err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// resetTopicSchemas clears the package-level topic registry and strict-mode
+// flag so tests don't leak state into one another.
+func resetTopicSchemas() {
+	topicSchemasMutex.Lock()
+	topicSchemas = make(map[string]TopicSchema)
+	topicSchemasMutex.Unlock()
+	strictTopics = false
+}
+
+// TestHandleTopicsRegisterAndFetch verifies that a registered schema can be
+// fetched back via GET /topics/{name}/schema.
+func TestHandleTopicsRegisterAndFetch(t *testing.T) {
+	resetTopicSchemas()
+
+	schema := TopicSchema{
+		Topic:       "greet",
+		InputSchema: json.RawMessage(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`),
+	}
+	body, _ := json.Marshal(schema)
+	req, _ := http.NewRequest("POST", "/topics", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	handleTopics(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	getReq, _ := http.NewRequest("GET", "/topics/greet/schema", nil)
+	getRR := httptest.NewRecorder()
+	handleTopicSchema(getRR, getReq)
+
+	if getRR.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", getRR.Code, http.StatusOK)
+	}
+	var got TopicSchema
+	if err := json.Unmarshal(getRR.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Topic != schema.Topic || string(got.InputSchema) != string(schema.InputSchema) {
+		t.Errorf("handler returned unexpected schema: got %+v, want %+v", got, schema)
+	}
+}
+
+// TestHandleTopicSchemaNotFound verifies that an unregistered topic's schema
+// lookup returns 404.
+func TestHandleTopicSchemaNotFound(t *testing.T) {
+	resetTopicSchemas()
+
+	req, _ := http.NewRequest("GET", "/topics/missing/schema", nil)
+	rr := httptest.NewRecorder()
+	handleTopicSchema(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// TestHandleTaskSubmitValidationFailure verifies that a task submitted to a
+// topic with a registered input schema is rejected with 422 when its input
+// doesn't conform.
+func TestHandleTaskSubmitValidationFailure(t *testing.T) {
+	resetTopicSchemas()
+	store = newMemoryStore()
+
+	registerTopicSchema(TopicSchema{
+		Topic:       "greet",
+		InputSchema: json.RawMessage(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`),
+	})
+
+	task := Task{Topic: "greet", Input: map[string]interface{}{"wrong_field": "value"}}
+	taskJSON, _ := json.Marshal(task)
+	req, _ := http.NewRequest("POST", "/task", bytes.NewBuffer(taskJSON))
+	rr := httptest.NewRecorder()
+	handleTaskSubmit(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+// TestHandleTaskSubmitStrictModeRejectsUnregisteredTopic verifies that with
+// strictTopics enabled, submissions to a topic with no registered schema are
+// rejected instead of silently accepted.
+func TestHandleTaskSubmitStrictModeRejectsUnregisteredTopic(t *testing.T) {
+	resetTopicSchemas()
+	store = newMemoryStore()
+	strictTopics = true
+	defer func() { strictTopics = false }()
+
+	task := Task{Topic: "unregistered", Input: map[string]interface{}{"k": "v"}}
+	taskJSON, _ := json.Marshal(task)
+	req, _ := http.NewRequest("POST", "/task", bytes.NewBuffer(taskJSON))
+	rr := httptest.NewRecorder()
+	handleTaskSubmit(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+// TestHandleSubmitResultValidationFailure verifies that a result whose
+// output fails the topic's registered output schema is rejected with 422.
+func TestHandleSubmitResultValidationFailure(t *testing.T) {
+	resetTopicSchemas()
+	store = newMemoryStore()
+
+	registerTopicSchema(TopicSchema{
+		Topic:        "greet",
+		OutputSchema: json.RawMessage(`{"type":"object","required":["greeting"],"properties":{"greeting":{"type":"string"}}}`),
+	})
+
+	testTask := Task{ID: "result-validation-id", Topic: "greet", Status: "new"}
+	store.SubmitTask(testTask)
+	if _, _, err := store.ReserveTask("greet"); err != nil {
+		t.Fatalf("ReserveTask: %v", err)
+	}
+
+	result := Result{ID: testTask.ID, Output: map[string]interface{}{"wrong_field": "hi"}}
+	resultJSON, _ := json.Marshal(result)
+	req, _ := http.NewRequest("POST", "/result", bytes.NewBuffer(resultJSON))
+	rr := httptest.NewRecorder()
+	handleSubmitResult(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+}